@@ -0,0 +1,144 @@
+package main
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BodyLimitPassthrough     = "passthrough"      // jq doesn't get to see the body, which is forwarded untouched
+	BodyLimitReject          = "reject"           // the request is rejected, 413 for request bodies and 502 for response bodies
+	BodyLimitTruncateContext = "truncate-context" // jq only gets to see the beginning of the body
+)
+
+// needsRequestBody tells whether the access phase has to read the request body.
+func (conf Config) needsRequestBody() bool {
+	return conf.RequestBody != "" || conf.DecodeBodies || conf.RequestSchema != "" || conf.Sign.CanonicalString != ""
+}
+
+// transformsResponse tells whether the response phase has anything to do.
+func (conf Config) transformsResponse() bool {
+	return conf.rewritesResponse() || conf.CacheKey != "" || conf.ResponseSchema != ""
+}
+
+// rewritesResponse tells whether a response program is configured.
+func (conf Config) rewritesResponse() bool {
+	return conf.ResponseHeaders != "" || conf.ResponseBody != "" || conf.StatusCode != ""
+}
+
+// skipResponse tells why the response should be left untouched given its headers, if it should.
+func (conf Config) skipResponse(kong *Kong) string {
+	if len(conf.SkipResponseContentTypes) > 0 {
+		contentType, _ := kong.ServiceResponse.GetHeader("content-type")
+
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && lo.SomeBy(conf.SkipResponseContentTypes, func(pattern string) bool {
+			return matchMediaType(pattern, mediaType)
+		}) {
+			return "content type"
+		}
+	}
+
+	if conf.SkipResponseLargerThan > 0 {
+		contentLength, _ := kong.ServiceResponse.GetHeader("content-length")
+
+		if length, err := strconv.Atoi(contentLength); err == nil && length > conf.SkipResponseLargerThan {
+			return "size"
+		}
+	}
+
+	return ""
+}
+
+// matchMediaType matches a media type against a pattern such as application/json or text/*.
+func matchMediaType(pattern, mediaType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+
+	return pattern == "*/*" || pattern == mediaType
+}
+
+// readRequestBody reads the request body, unless its Content-Length already tells it exceeds
+// the limit and only its size is needed to apply the policy.
+func (conf Config) readRequestBody(kong *Kong) (body []byte, size int, err error) {
+	if length, over := conf.contentLengthOver(kong.Request.GetHeader, conf.MaxRequestBodyBytes); over {
+		return nil, length, nil
+	}
+
+	body, err = kong.Request.GetRawBody()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, len(body), nil
+}
+
+// readResponseBody reads the upstream response body, unless its Content-Length already tells it
+// exceeds the limit, sparing kong sending it over to the plugin server.
+func (conf Config) readResponseBody(kong *Kong) (body []byte, size int, err error) {
+	if length, over := conf.contentLengthOver(kong.ServiceResponse.GetHeader, conf.MaxResponseBodyBytes); over {
+		return nil, length, nil
+	}
+
+	body, err = kong.ServiceResponse.GetRawBody()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, len(body), nil
+}
+
+// contentLengthOver returns the Content-Length of a body when it exceeds the limit, as long as the
+// policy doesn't need the body itself.
+func (conf Config) contentLengthOver(getHeader func(string) (string, error), limit int) (int, bool) {
+	if limit <= 0 || conf.BodyLimitPolicy == BodyLimitTruncateContext {
+		return 0, false
+	}
+
+	contentLength, err := getHeader("content-length")
+	if err != nil || contentLength == "" {
+		return 0, false
+	}
+
+	length, err := strconv.Atoi(contentLength)
+	if err != nil || length <= limit {
+		return 0, false
+	}
+
+	return length, true
+}
+
+// limitBody applies the body limit policy, it returns the body as jq gets to see it (nil if it
+// doesn't), whether it was truncated, and false when the body must be rejected.
+func (conf Config) limitBody(logger *logrus.Entry, body []byte, size, limit int) (any, bool, bool) {
+	if limit <= 0 || size <= limit {
+		return string(body), false, true
+	}
+
+	policy := conf.BodyLimitPolicy
+	if policy == "" {
+		policy = BodyLimitPassthrough
+	}
+
+	logger.WithFields(logrus.Fields{
+		"body_size":  size,
+		"body_limit": limit,
+		"policy":     policy,
+	}).Warn("body exceeds the limit")
+
+	switch policy {
+	case BodyLimitReject:
+		return nil, false, false
+	case BodyLimitTruncateContext:
+		return string(body[:min(limit, len(body))]), true, true
+	default:
+		return nil, false, true
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"
+	CacheBypass = "BYPASS"
+)
+
+var (
+	CacheHeader = "X-Kong-Jq-Cache" // tells whether the response comes from the cache
+
+	DefaultCacheMaxEntries    = 1000
+	DefaultCacheMaxEntryBytes = 1 << 20
+
+	cacheSharedKey = "kong_jq_cache" // kong.ctx.shared key passing the cache key over to the response phase
+)
+
+type cacheEntry struct {
+	key       string
+	status    int
+	body      []byte
+	headers   map[string][]string
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+// lruCache is a size bounded cache of transformed responses, the least recently used entries
+// are evicted first.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // front is the most recently used
+}
+
+func newLRUCache(maxEntries int) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+func (c *lruCache) get(key string, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if now.After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+
+	return entry, true
+}
+
+func (c *lruCache) set(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+
+		return
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// responseCaches holds a cache by plugin instance, as each instance has its own size limits.
+var (
+	responseCachesMu sync.Mutex
+	responseCaches   = map[string]*lruCache{}
+)
+
+func (conf Config) responseCache() *lruCache {
+	responseCachesMu.Lock()
+	defer responseCachesMu.Unlock()
+
+	cache, ok := responseCaches[conf.instance]
+	if !ok {
+		cache = newLRUCache(lo.Ternary(conf.CacheMaxEntries > 0, conf.CacheMaxEntries, DefaultCacheMaxEntries))
+		responseCaches[conf.instance] = cache
+	}
+
+	return cache
+}
+
+// cacheKey encodes the result of the cache key query, false and null results bypass the cache.
+func cacheKey(result any) (string, bool) {
+	if !truthy(result) {
+		return "", false
+	}
+
+	b, err := json.Marshal(result) // maps are encoded with sorted keys, the key is stable
+	if err != nil {
+		return "", false
+	}
+
+	return string(b), true
+}
+
+// cachedHeaders returns the headers of a cached response, with the cache headers added.
+func (entry *cacheEntry) cachedHeaders(now time.Time) map[string][]string {
+	return lo.Assign(entry.headers, map[string][]string{
+		CacheHeader: {CacheHit},
+		"Age":       {strconv.Itoa(int(now.Sub(entry.storedAt).Seconds()))},
+	})
+}
+
+// cachedResponseHeaders returns the headers a response is cached with out of the ones it's sent
+// with: never the hop-by-hop ones nor Content-Length, and not the ones describing the upstream
+// body either when the cached body isn't the upstream one, replaced or decompressed, whatever set
+// them. A replaced body gets its ETag back when asked to, as it's cached as is.
+func (conf Config) cachedResponseHeaders(headers map[string][]string, body []byte, upstreamBody, replaced bool) map[string][]string {
+	omitted := slices.Concat(lo.Ternary(upstreamBody, []string{"Content-Length"}, StaleBodyHeaders), hopByHopHeaders)
+
+	headers = lo.OmitBy(headers, func(k string, _ []string) bool {
+		return lo.ContainsBy(omitted, func(name string) bool { return strings.EqualFold(k, name) })
+	})
+
+	if replaced && conf.ETag {
+		headers["ETag"] = []string{bodyETag(body)}
+	}
+
+	return headers
+}
+
+// forbidsStoring tells whether a Cache-Control header forbids shared caches to store a response.
+func forbidsStoring(cacheControl string) bool {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+
+		if name == "no-store" || name == "private" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cacheControlTTL returns how long a response may be cached according to its Cache-Control header.
+func cacheControlTTL(cacheControl string) time.Duration {
+	var maxAge, sMaxAge *int
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				maxAge = &seconds
+			}
+		case "s-maxage":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				sMaxAge = &seconds
+			}
+		}
+	}
+
+	switch {
+	case sMaxAge != nil:
+		return time.Duration(*sMaxAge) * time.Second
+	case maxAge != nil:
+		return time.Duration(*maxAge) * time.Second
+	default:
+		return 0
+	}
+}
+
+// ttlSeconds converts the result of the cache TTL query, anything but a number meaning the
+// response isn't cached.
+func ttlSeconds(result any) time.Duration {
+	switch result := result.(type) {
+	case int:
+		return time.Duration(result) * time.Second
+	case float64:
+		return time.Duration(result * float64(time.Second))
+	default:
+		return 0
+	}
+}
+
+// storeResponse caches a transformed response for as long as the cache TTL query says, or as
+// long as its Cache-Control allows when there isn't any. Responses setting cookies, and the ones
+// whose upstream or cached Cache-Control is private or no-store, are never cached, the TTL query
+// notwithstanding. Failing to cache a response isn't fatal.
+func (conf Config) storeResponse(
+	ctx context.Context,
+	logger *logrus.Entry,
+	kong *Kong,
+	arguments map[string]any,
+	key string,
+	status int,
+	body []byte,
+	headers map[string][]string,
+) {
+	upstreamCacheControl, _ := kong.ServiceResponse.GetHeader("cache-control")
+
+	if lo.SomeBy(append(headerValuesOf(headers, "Cache-Control"), upstreamCacheControl), forbidsStoring) {
+		logger.Info("response not cached, its cache-control forbids it")
+
+		return
+	}
+
+	if hasHeader(headers, "Set-Cookie") {
+		logger.Info("response not cached, it sets cookies")
+
+		return
+	}
+
+	var ttl time.Duration
+
+	if conf.CacheTTL != "" {
+		next, ok := runQuery(ctx, conf, PhaseResponse, FieldCacheTTL, conf.CacheTTL, arguments)
+		if !ok {
+			return
+		}
+
+		if err, ok := next.(error); ok {
+			logger.WithError(err).Error(ErrorCacheTTL)
+
+			return
+		}
+
+		ttl = ttlSeconds(next)
+	} else {
+		ttl = cacheControlTTL(upstreamCacheControl)
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	if maxEntryBytes := lo.Ternary(conf.CacheMaxEntryBytes > 0, conf.CacheMaxEntryBytes, DefaultCacheMaxEntryBytes); len(body) > maxEntryBytes {
+		logger.WithField("body_size", len(body)).Info("response too large to be cached")
+
+		return
+	}
+
+	now := time.Now()
+
+	conf.responseCache().set(&cacheEntry{
+		key:       key,
+		status:    status,
+		body:      body,
+		headers:   lo.OmitByKeys(headers, []string{CacheHeader}),
+		storedAt:  now,
+		expiresAt: now.Add(ttl),
+	})
+}
+
+// cacheState is what the access phase tells the response phase about the cache.
+type cacheState struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+}
+
+func saveCacheState(kong *Kong, state cacheState) error {
+	return kong.Ctx.SetShared(cacheSharedKey, string(lo.Must(json.Marshal(state))))
+}
+
+func loadCacheState(kong *Kong) (cacheState, bool) {
+	var state cacheState
+
+	s, err := kong.Ctx.GetSharedString(cacheSharedKey)
+	if err != nil || s == "" {
+		return state, false
+	}
+
+	if err := json.Unmarshal([]byte(s), &state); err != nil {
+		return state, false
+	}
+
+	return state, true
+}
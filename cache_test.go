@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// TestCacheDecompressedBody checks that a response whose body is cached decompressed is served
+// from the cache without the Content-Encoding of the upstream body, even when the response
+// headers program passes it along.
+func TestCacheDecompressedBody(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		ResponseHeaders: `.response.headers + {"x-cached": "1"}`,
+		ContextVersion:  ContextV2,
+		CacheKey:        `.request.path`,
+		CacheTTL:        `60`,
+		instance:        "cache-decompressed-test",
+	}
+
+	body := `{"id": 1}`
+
+	upstream := func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{
+			Status: http.StatusOK,
+			Headers: map[string][]string{
+				"Content-Type":     {"application/json"},
+				"Content-Encoding": {EncodingGzip},
+				"ETag":             {`"gz"`},
+			},
+			Body: string(lo.Must(compressBody(EncodingGzip, []byte(body)))),
+		}, nil
+	}
+
+	for _, expected := range []string{CacheMiss, CacheHit} {
+		_, response, err := conf.Play(HTTPRequest{Method: http.MethodGet, Path: "/users/1"}, upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := firstValue(response.Headers, CacheHeader); got != expected {
+			t.Fatalf("expected a cache %s, got %q", expected, got)
+		}
+
+		if expected == CacheMiss {
+			continue
+		}
+
+		if response.Body != body {
+			t.Errorf("expected the decompressed body %s, got %q", body, response.Body)
+		}
+
+		for _, k := range []string{"content-encoding", "etag"} {
+			if values := response.Headers[k]; len(values) > 0 {
+				t.Errorf("expected no %s header on a hit, got %v", k, values)
+			}
+		}
+
+		if firstValue(response.Headers, "x-cached") != "1" {
+			t.Errorf("expected the headers of the program on a hit, got %v", response.Headers)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v3"
+)
+
+// commands are the subcommands running the plugin without kong, kong itself only passes flags.
+var commands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"test":   runTestCommand,
+	"eval":   runEvalCommand,
+	"serve":  runServeCommand,
+	"schema": runSchemaCommand,
+}
+
+// loadYAML decodes a YAML or JSON file into v, going through JSON so that the json tags apply.
+func loadYAML(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var document any
+	if err := yaml.Unmarshal(b, &document); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(lo.Must(json.Marshal(document)), v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// configFieldNames are the names kong gives to the configuration fields: their json tag, or
+// their lower-cased name when they don't have any.
+func configFieldNames() []string {
+	t := reflect.TypeOf(Config{})
+
+	return lo.FilterMap(reflect.VisibleFields(t), func(field reflect.StructField, _ int) (string, bool) {
+		if !field.IsExported() {
+			return "", false
+		}
+
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" {
+			return name, true
+		}
+
+		return strings.ToLower(field.Name), true
+	})
+}
+
+// LoadConfig reads a plugin configuration file, YAML or JSON. Besides the names kong uses, the
+// fields without a json tag can be given the snake case names the documentation uses, such as
+// response_body for responsebody.
+func LoadConfig(path string) (Config, error) {
+	var (
+		document map[string]any
+		conf     Config
+	)
+
+	if err := loadYAML(path, &document); err != nil {
+		return conf, err
+	}
+
+	names := configFieldNames()
+
+	for k, v := range document {
+		if name := strings.ReplaceAll(k, "_", ""); !slices.Contains(names, k) && slices.Contains(names, name) {
+			delete(document, k)
+			document[name] = v
+		}
+	}
+
+	if err := json.Unmarshal(lo.Must(json.Marshal(document)), &conf); err != nil {
+		return conf, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return conf, nil
+}
+
+// Fixture is a recorded exchange the test subcommand plays through the plugin. The expectations
+// are optional, only the parts they give are checked.
+type Fixture struct {
+	Name                    string            `json:"name"`
+	Request                 HTTPRequest       `json:"request"`
+	UpstreamResponse        HTTPResponse      `json:"upstream_response"`
+	ExpectedUpstreamRequest *ExpectedRequest  `json:"expected_upstream_request"`
+	ExpectedClientResponse  *ExpectedResponse `json:"expected_client_response"`
+}
+
+// ExpectedRequest is what the upstream request is expected to be. A header expected with no
+// values is expected to be absent, the headers it doesn't list aren't checked.
+type ExpectedRequest struct {
+	Method  *string             `json:"method"`
+	Path    *string             `json:"path"`
+	Query   map[string][]string `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    *string             `json:"body"`
+}
+
+// ExpectedResponse is what the client response is expected to be, the headers being checked
+// like the ones of ExpectedRequest.
+type ExpectedResponse struct {
+	Status  *int                `json:"status"`
+	Headers map[string][]string `json:"headers"`
+	Body    *string             `json:"body"`
+}
+
+// Diff describes a difference between an expectation and what the plugin did.
+type Diff struct {
+	What     string
+	Expected any
+	Got      any
+}
+
+func diffHeaders(what string, expected, got map[string][]string) []Diff {
+	diffs := []Diff{}
+
+	for _, k := range lo.Keys(expected) {
+		expectedValues := expected[k]
+		gotValues := got[strings.ToLower(k)]
+
+		if len(expectedValues) != len(gotValues) || (len(expectedValues) > 0 && !slices.Equal(expectedValues, gotValues)) {
+			diffs = append(diffs, Diff{What: what + " header " + strings.ToLower(k), Expected: expectedValues, Got: gotValues})
+		}
+	}
+
+	slices.SortFunc(diffs, func(a, b Diff) int { return strings.Compare(a.What, b.What) })
+
+	return diffs
+}
+
+// sameBody compares two bodies, semantically when both are JSON documents.
+func sameBody(expected, got string) bool {
+	if expected == got {
+		return true
+	}
+
+	var expectedJSON, gotJSON any
+
+	if json.Unmarshal([]byte(expected), &expectedJSON) != nil || json.Unmarshal([]byte(got), &gotJSON) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(expectedJSON, gotJSON)
+}
+
+func (expected *ExpectedRequest) diff(got *HTTPRequest) []Diff {
+	if got == nil {
+		return []Diff{{What: "upstream request", Expected: "a request", Got: "the access phase ended the request"}}
+	}
+
+	diffs := []Diff{}
+
+	if expected.Method != nil && *expected.Method != got.Method {
+		diffs = append(diffs, Diff{What: "upstream request method", Expected: *expected.Method, Got: got.Method})
+	}
+
+	if expected.Path != nil && *expected.Path != got.Path {
+		diffs = append(diffs, Diff{What: "upstream request path", Expected: *expected.Path, Got: got.Path})
+	}
+
+	if expected.Query != nil && (len(expected.Query) > 0 || len(got.Query) > 0) && !reflect.DeepEqual(expected.Query, got.Query) {
+		diffs = append(diffs, Diff{What: "upstream request query", Expected: expected.Query, Got: got.Query})
+	}
+
+	diffs = append(diffs, diffHeaders("upstream request", expected.Headers, got.Headers)...)
+
+	if expected.Body != nil && !sameBody(*expected.Body, got.Body) {
+		diffs = append(diffs, Diff{What: "upstream request body", Expected: *expected.Body, Got: got.Body})
+	}
+
+	return diffs
+}
+
+func (expected *ExpectedResponse) diff(got HTTPResponse) []Diff {
+	diffs := []Diff{}
+
+	if expected.Status != nil && *expected.Status != got.Status {
+		diffs = append(diffs, Diff{What: "client response status", Expected: *expected.Status, Got: got.Status})
+	}
+
+	diffs = append(diffs, diffHeaders("client response", expected.Headers, got.Headers)...)
+
+	if expected.Body != nil && !sameBody(*expected.Body, got.Body) {
+		diffs = append(diffs, Diff{What: "client response body", Expected: *expected.Body, Got: got.Body})
+	}
+
+	return diffs
+}
+
+// Run plays the fixture through the plugin and returns how the outcome differs from the expectations.
+func (fixture Fixture) Run(conf Config) ([]Diff, error) {
+	upstreamRequest, clientResponse, err := conf.Play(fixture.Request, func(HTTPRequest) (HTTPResponse, error) {
+		return fixture.UpstreamResponse, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []Diff{}
+
+	if fixture.ExpectedUpstreamRequest != nil {
+		diffs = append(diffs, fixture.ExpectedUpstreamRequest.diff(upstreamRequest)...)
+	}
+
+	if fixture.ExpectedClientResponse != nil {
+		diffs = append(diffs, fixture.ExpectedClientResponse.diff(clientResponse)...)
+	}
+
+	return diffs, nil
+}
+
+func formatValue(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	var buf bytes.Buffer
+
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	lo.Must0(encoder.Encode(v))
+
+	return strings.TrimSpace(buf.String())
+}
+
+// runTestCommand plays fixture files through a plugin configuration and reports the differences
+// with their expectations, it exits with 1 when some fixture fails and 2 when it can't run them.
+//
+//	kong-jq-plugin test --config plugin.yaml fixtures/*.json
+func runTestCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "", "the plugin configuration file, YAML or JSON")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *configPath == "" || flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "usage: kong-jq-plugin test --config plugin.yaml fixture.json…")
+
+		return 2
+	}
+
+	conf, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+
+		return 2
+	}
+
+	failed := 0
+
+	for _, path := range flags.Args() {
+		var fixture Fixture
+
+		if err := loadYAML(path, &fixture); err != nil {
+			fmt.Fprintln(stderr, err)
+
+			return 2
+		}
+
+		name := lo.Ternary(fixture.Name != "", fixture.Name, path)
+
+		// each fixture starts with an empty response cache
+		conf.instance = path + "#" + name
+
+		diffs, err := fixture.Run(conf)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+
+			return 2
+		}
+
+		if len(diffs) == 0 {
+			fmt.Fprintf(stdout, "PASS %s\n", name)
+
+			continue
+		}
+
+		failed++
+
+		fmt.Fprintf(stdout, "FAIL %s\n", name)
+
+		for _, diff := range diffs {
+			fmt.Fprintf(stdout, "    %s:\n        expected: %s\n        got:      %s\n", diff.What, formatValue(diff.Expected), formatValue(diff.Got))
+		}
+	}
+
+	fmt.Fprintf(stdout, "%d fixtures, %d failed\n", flags.NArg(), failed)
+
+	return lo.Ternary(failed > 0, 1, 0)
+}
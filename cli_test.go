@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeFile writes a file in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// TestTestCommand runs the test subcommand over passing, failing and missing fixtures, and
+// checks its report and its exit code.
+func TestTestCommand(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	dir := t.TempDir()
+
+	config := writeFile(t, dir, "plugin.yaml", `
+path: '"/v2" + .request.path'
+response_body: '{id: .response.json.id}'
+decode_bodies: true
+`)
+
+	passing := writeFile(t, dir, "passing.yaml", `
+name: rewrites the path
+request:
+  method: GET
+  path: /users/7
+upstream_response:
+  status: 200
+  headers:
+    content-type: [application/json]
+  body: '{"id": 7, "name": "Ada"}'
+expected_upstream_request:
+  path: /v2/users/7
+expected_client_response:
+  status: 200
+  headers:
+    content-type: [application/json]
+  body: '{ "id": 7 }'
+`)
+
+	failing := writeFile(t, dir, "failing.yaml", `
+request:
+  method: GET
+  path: /users/7
+upstream_response:
+  status: 200
+  headers:
+    content-type: [application/json]
+  body: '{"id": 7, "name": "Ada"}'
+expected_upstream_request:
+  path: /users/7
+expected_client_response:
+  headers:
+    content-type: [application/json]
+    etag: []
+  body: '{"id": 8}'
+`)
+
+	for _, tt := range []struct {
+		name     string
+		args     []string
+		code     int
+		stdout   []string
+		stderr   string
+		noStdout bool
+	}{
+		{
+			name:   "passing",
+			args:   []string{"--config", config, passing},
+			code:   0,
+			stdout: []string{"PASS rewrites the path\n", "1 fixtures, 0 failed\n"},
+		},
+		{
+			name: "failing",
+			args: []string{"--config", config, passing, failing},
+			code: 1,
+			stdout: []string{
+				"PASS rewrites the path\n",
+				"FAIL " + failing + "\n" +
+					"    upstream request path:\n        expected: /users/7\n        got:      /v2/users/7\n" +
+					"    client response body:\n        expected: {\"id\": 8}\n        got:      {\"id\":7}\n",
+				"2 fixtures, 1 failed\n",
+			},
+		},
+		{
+			name:     "missing fixture",
+			args:     []string{"--config", config, filepath.Join(dir, "missing.yaml")},
+			code:     2,
+			stderr:   "missing.yaml",
+			noStdout: true,
+		},
+		{
+			name:     "missing config",
+			args:     []string{"--config", filepath.Join(dir, "missing.yaml"), passing},
+			code:     2,
+			stderr:   "missing.yaml",
+			noStdout: true,
+		},
+		{
+			name:     "no fixture",
+			args:     []string{"--config", config},
+			code:     2,
+			stderr:   "usage: kong-jq-plugin test",
+			noStdout: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			if code := runTestCommand(tt.args, &stdout, &stderr); code != tt.code {
+				t.Errorf("expected the exit code %d, got %d\nstdout: %s\nstderr: %s", tt.code, code, stdout.String(), stderr.String())
+			}
+
+			for _, expected := range tt.stdout {
+				if !strings.Contains(stdout.String(), expected) {
+					t.Errorf("expected %q in the output, got:\n%s", expected, stdout.String())
+				}
+			}
+
+			if tt.noStdout && stdout.Len() > 0 {
+				t.Errorf("expected no report, got:\n%s", stdout.String())
+			}
+
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("expected %q in the errors, got:\n%s", tt.stderr, stderr.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/samber/lo"
+)
+
+const (
+	EncodingIdentity = ""
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate"
+	EncodingBrotli   = "br"
+)
+
+// SupportedEncodings are the content codings we can decompress and compress, by order of preference.
+var SupportedEncodings = []string{EncodingBrotli, EncodingGzip, EncodingDeflate}
+
+// MaxDecompressedBodyBytes caps the size a body decompresses to when there is no body size limit.
+const MaxDecompressedBodyBytes = 16 << 20
+
+var (
+	ErrContentEncoding          = errors.New("unsupported content encoding")
+	ErrDecompressedBodyTooLarge = errors.New("decompressed body is too large")
+)
+
+// contentEncoding normalizes a Content-Encoding header, only a single coding is supported.
+func contentEncoding(header string) (string, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header))
+
+	switch encoding {
+	case "", "identity":
+		return EncodingIdentity, nil
+	case "x-gzip":
+		return EncodingGzip, nil
+	case EncodingGzip, EncodingDeflate, EncodingBrotli:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrContentEncoding, header)
+	}
+}
+
+// decompressBody decodes a body, it reads at most limit+1 bytes when there is a limit so that
+// the caller can tell it's over the limit without inflating the whole body. Without a limit, a
+// body decompressing to more than MaxDecompressedBodyBytes is an ErrDecompressedBodyTooLarge.
+func decompressBody(encoding string, body []byte, limit int) ([]byte, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+
+	switch encoding {
+	case EncodingIdentity:
+		return body, nil
+	case EncodingGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case EncodingDeflate:
+		// deflate is supposed to be zlib wrapped, some servers send raw deflate anyway
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	case EncodingBrotli:
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrContentEncoding, encoding)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	capped := limit <= 0
+	if capped {
+		limit = MaxDecompressedBodyBytes
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if capped && len(decoded) > limit {
+		return nil, ErrDecompressedBodyTooLarge
+	}
+
+	return decoded, nil
+}
+
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var (
+		buf    bytes.Buffer
+		writer io.WriteCloser
+	)
+
+	switch encoding {
+	case EncodingIdentity:
+		return body, nil
+	case EncodingGzip:
+		writer = gzip.NewWriter(&buf)
+	case EncodingDeflate:
+		writer = zlib.NewWriter(&buf)
+	case EncodingBrotli:
+		writer = brotli.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrContentEncoding, encoding)
+	}
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// negotiateEncoding picks the supported content coding the client prefers according to its
+// Accept-Encoding header, the upstream one winning ties and then our order of preference. A
+// coding the header names gets its own quality, the others the one of "*" if any. It returns
+// EncodingIdentity when the client doesn't accept any of them.
+func negotiateEncoding(acceptEncoding, upstream string) string {
+	qualities, wildcard := map[string]float64{}, 0.0
+
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+
+		quality := 1.0
+
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		if coding == "*" {
+			wildcard = quality
+		} else {
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := EncodingIdentity, 0.0
+
+	for _, candidate := range SupportedEncodings {
+		quality := lo.ValueOr(qualities, candidate, wildcard)
+		if quality <= 0 {
+			continue
+		}
+
+		if quality > bestQuality || (quality == bestQuality && candidate == upstream) {
+			best, bestQuality = candidate, quality
+		}
+	}
+
+	return best
+}
+
+// encodeResponseBody sets the encoding of a replaced response body whose upstream body was encoded.
+// It's re-compressed in the coding the client prefers when compress_response is enabled, and sent
+// as is otherwise.
+func (conf Config) encodeResponseBody(
+	kong *Kong,
+	headers map[string][]string,
+	body []byte,
+	upstream string,
+) (map[string][]string, []byte, error) {
+	// the upstream headers are still there when the response headers program is skipped
+	for _, k := range []string{"Content-Encoding", "Content-Length"} {
+		if err := kong.Response.ClearHeader(k); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	headers = lo.OmitBy(headers, func(k string, _ []string) bool {
+		return strings.EqualFold(k, "Content-Encoding") || strings.EqualFold(k, "Content-Length")
+	})
+
+	encoding := EncodingIdentity
+
+	if conf.CompressResponse {
+		acceptEncoding, _ := kong.Request.GetHeader("accept-encoding")
+		encoding = negotiateEncoding(acceptEncoding, upstream)
+	}
+
+	body, err := compressBody(encoding, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if encoding != EncodingIdentity {
+		headers["Vary"] = append(headers["Vary"], "Accept-Encoding")
+		headers["Content-Encoding"] = []string{encoding}
+
+		// a strong ETag is specific to a representation, the compressed one has its own
+		if conf.ETag {
+			headers["ETag"] = []string{bodyETag(body)}
+		}
+	}
+
+	return headers, body, nil
+}
+
+// upstreamBodyHeaders sets the Content-Encoding and Content-Length of the upstream response over
+// the headers of a response whose body is sent as it came.
+func upstreamBodyHeaders(kong *Kong, headers map[string][]string) map[string][]string {
+	headers = lo.OmitBy(headers, func(k string, _ []string) bool {
+		return strings.EqualFold(k, "Content-Encoding") || strings.EqualFold(k, "Content-Length")
+	})
+
+	for _, k := range []string{"Content-Encoding", "Content-Length"} {
+		if value, _ := kong.ServiceResponse.GetHeader(k); value != "" {
+			headers[k] = []string{value}
+		}
+	}
+
+	return headers
+}
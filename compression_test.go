@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// TestCompressedETag checks that a body compress_response compresses gets the ETag of the
+// compressed bytes, not the one of the uncompressed body.
+func TestCompressedETag(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		ResponseBody:     `{id: .response.json.id}`,
+		DecodeBodies:     true,
+		ETag:             true,
+		CompressResponse: true,
+	}
+
+	upstream := func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{
+			Status: http.StatusOK,
+			Headers: map[string][]string{
+				"Content-Type":     {"application/json"},
+				"Content-Encoding": {EncodingGzip},
+			},
+			Body: string(lo.Must(compressBody(EncodingGzip, []byte(`{"id": 7, "name": "Ada"}`)))),
+		}, nil
+	}
+
+	for acceptEncoding, expectedEncoding := range map[string]string{EncodingGzip: EncodingGzip, EncodingIdentity: ""} {
+		_, response, err := conf.Play(HTTPRequest{
+			Method:  http.MethodGet,
+			Path:    "/users/7",
+			Headers: map[string][]string{"Accept-Encoding": {acceptEncoding}},
+		}, upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := firstValue(response.Headers, "content-encoding"); got != expectedEncoding {
+			t.Fatalf("expected the %q encoding for %s, got %q", expectedEncoding, acceptEncoding, got)
+		}
+
+		if expected := bodyETag([]byte(response.Body)); firstValue(response.Headers, "etag") != expected {
+			t.Errorf("expected the ETag of the body sent %s for %s, got %v", expected, acceptEncoding, response.Headers["etag"])
+		}
+	}
+}
+
+// TestDecompressBody decompresses bodies in each supported coding and checks the limits: a body
+// over the limit is read up to limit+1 bytes, and without a limit it can't inflate past
+// MaxDecompressedBodyBytes.
+func TestDecompressBody(t *testing.T) {
+	body := []byte(`{"id": 7, "name": "Ada"}`)
+	bomb := lo.Must(compressBody(EncodingGzip, make([]byte, MaxDecompressedBodyBytes+1)))
+
+	var rawDeflate bytes.Buffer
+
+	writer := lo.Must(flate.NewWriter(&rawDeflate, flate.DefaultCompression))
+	lo.Must(writer.Write(body))
+	lo.Must0(writer.Close())
+
+	for _, tt := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		limit    int
+		expected []byte
+		err      error
+	}{
+		{name: "identity", encoding: EncodingIdentity, body: body, expected: body},
+		{name: "gzip", encoding: EncodingGzip, body: lo.Must(compressBody(EncodingGzip, body)), expected: body},
+		{name: "deflate", encoding: EncodingDeflate, body: lo.Must(compressBody(EncodingDeflate, body)), expected: body},
+		{name: "raw deflate", encoding: EncodingDeflate, body: rawDeflate.Bytes(), expected: body},
+		{name: "brotli", encoding: EncodingBrotli, body: lo.Must(compressBody(EncodingBrotli, body)), expected: body},
+		{name: "over the limit", encoding: EncodingGzip, body: lo.Must(compressBody(EncodingGzip, body)), limit: 9, expected: body[:10]},
+		{name: "over the default cap", encoding: EncodingGzip, body: bomb, err: ErrDecompressedBodyTooLarge},
+		{name: "corrupt gzip", encoding: EncodingGzip, body: body, err: gzip.ErrHeader},
+		{name: "unsupported", encoding: "zstd", body: body, err: ErrContentEncoding},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decompressBody(tt.encoding, tt.body, tt.limit)
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(decoded, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, decoded)
+			}
+		})
+	}
+}
+
+// TestNegotiateEncoding checks the coding picked for the Accept-Encoding of the client.
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		acceptEncoding string
+		upstream       string
+		expected       string
+	}{
+		{acceptEncoding: "", upstream: EncodingGzip, expected: EncodingIdentity},
+		{acceptEncoding: "gzip", upstream: EncodingIdentity, expected: EncodingGzip},
+		{acceptEncoding: "x-gzip", upstream: EncodingIdentity, expected: EncodingGzip},
+		{acceptEncoding: "gzip;q=0.5, br", upstream: EncodingGzip, expected: EncodingBrotli},
+		{acceptEncoding: "gzip, br", upstream: EncodingGzip, expected: EncodingGzip},
+		{acceptEncoding: "gzip, br", upstream: EncodingIdentity, expected: EncodingBrotli},
+		{acceptEncoding: "*", upstream: EncodingDeflate, expected: EncodingDeflate},
+		{acceptEncoding: "*;q=0.1, gzip;q=0", upstream: EncodingGzip, expected: EncodingBrotli},
+		{acceptEncoding: "gzip;q=0", upstream: EncodingGzip, expected: EncodingIdentity},
+		{acceptEncoding: "zstd, identity", upstream: EncodingIdentity, expected: EncodingIdentity},
+	} {
+		if got := negotiateEncoding(tt.acceptEncoding, tt.upstream); got != tt.expected {
+			t.Errorf("expected %q for %q with a %q upstream, got %q", tt.expected, tt.acceptEncoding, tt.upstream, got)
+		}
+	}
+}
+
+// TestRequestBodyEncoding checks the replies to request bodies that can't be decompressed: a 415
+// for a coding we don't support, a 413 for a body inflating over its cap and a 400 for a
+// corrupt body.
+func TestRequestBodyEncoding(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{RequestBody: `.request.body`}
+
+	for _, tt := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		message  string
+	}{
+		{name: "unsupported", encoding: "zstd", body: []byte("id=7"), status: http.StatusUnsupportedMediaType, message: ErrorRequestBodyCoding},
+		{
+			name:     "over the cap",
+			encoding: EncodingGzip,
+			body:     lo.Must(compressBody(EncodingGzip, make([]byte, MaxDecompressedBodyBytes+1))),
+			status:   http.StatusRequestEntityTooLarge,
+			message:  ErrorRequestBodyTooLarge,
+		},
+		{name: "corrupt", encoding: EncodingGzip, body: []byte("id=7"), status: http.StatusBadRequest, message: ErrorRequestBodyEncoding},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, response, err := conf.Play(HTTPRequest{
+				Method:  http.MethodPost,
+				Path:    "/orders",
+				Headers: map[string][]string{"Content-Encoding": {tt.encoding}},
+				Body:    string(tt.body),
+			}, func(HTTPRequest) (HTTPResponse, error) {
+				t.Fatal("the request reached the upstream")
+
+				return HTTPResponse{}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.Status != tt.status || response.Body != tt.message {
+				t.Errorf("expected a %d %q, got a %d %q", tt.status, tt.message, response.Status, response.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+const (
+	ContextV1 = 1 // the original context: request.headers in the access phase only, response.headers always empty
+	ContextV2 = 2 // the same request and response shapes in both phases
+)
+
+// JQContext is the input of the jq programs. Fields tagged omitempty are left out when nil, and
+// so are the fields of a nil embedded struct.
+type JQContext struct {
+	Version  int              `json:"context_version,omitempty" description:"The version of the context shape, only given from version 2 on."`
+	Request  *RequestContext  `json:"request" description:"The client request, as transformed by the programs that already ran."`
+	Response *ResponseContext `json:"response,omitempty" description:"The upstream response, in the response phase only."`
+	Route    *RouteContext    `json:"route,omitempty" description:"The route matched by the request. Version 1 only gives it when cors is configured."`
+	JWT      *JWTContext      `json:"jwt,omitempty" description:"The bearer token of the request, when jwt is configured."`
+	Consumer *ConsumerContext `json:"consumer,omitempty" description:"The consumer the request is authenticated as, left out without one. Version 1 only gives it when cors is configured."`
+}
+
+type RequestContext struct {
+	Method      string              `json:"method" description:"The request method."`
+	Path        string              `json:"path" description:"The request path, without the query string."`
+	Args        []string            `json:"args" description:"The unnamed captures of the route path regex."`
+	Kwargs      map[string]string   `json:"kwargs" description:"The named captures of the route path regex."`
+	QueryParams map[string][]string `json:"query_params" description:"The query params, as lists of values."`
+	RawQuery    string              `json:"raw_query" description:"The query string as the client sent it, without the leading question mark."`
+	Headers     map[string][]string `json:"headers,omitempty" description:"The request headers with lower-cased names, as lists of values. Version 1 only gives them in the access phase."`
+	*BodyContext
+}
+
+type ResponseContext struct {
+	StatusCode int                 `json:"status_code" description:"The upstream status code."`
+	Headers    map[string][]string `json:"headers" description:"The upstream headers with lower-cased names, as lists of values. Always empty in version 1."`
+	*BodyContext
+}
+
+type RouteContext struct {
+	ID    string   `json:"id" description:"The route id."`
+	Name  string   `json:"name" description:"The route name."`
+	Hosts []string `json:"hosts" description:"The hosts of the route."`
+	Paths []string `json:"paths" description:"The paths of the route."`
+	Tags  []string `json:"tags" description:"The tags of the route."`
+}
+
+type ConsumerContext struct {
+	ID       string   `json:"id" description:"The consumer id."`
+	Username string   `json:"username" description:"The consumer username."`
+	CustomID string   `json:"custom_id" description:"The consumer custom id."`
+	Tags     []string `json:"tags" description:"The tags of the consumer."`
+}
+
+// BodyContext is a body as jq gets to see it. Version 1 only gives the request body when a program needs it.
+type BodyContext struct {
+	Body          any  `json:"body" description:"The body as a string, null when it's over the size limit and passed through."`
+	BodyTruncated bool `json:"body_truncated" description:"Whether the body is only the beginning of the actual body, as it's over the size limit."`
+	JSON          any  `json:"json" description:"The body decoded according to its Content-Type, null unless decode_bodies is set or when it can't be decoded."`
+}
+
+// contextVersion returns the context version of the configuration, version 1 by default.
+func (conf Config) contextVersion() int {
+	return lo.Ternary(conf.ContextVersion >= ContextV2, ContextV2, ContextV1)
+}
+
+// newContext builds the context of a phase, with the request part but without the request body.
+func (conf Config) newContext(kong *Kong, phase string) JQContext {
+	jqContext := JQContext{
+		Version: lo.Ternary(conf.contextVersion() >= ContextV2, conf.contextVersion(), 0),
+		Request: conf.newRequestContext(kong, phase),
+	}
+
+	// both take a call to kong, version 1 doesn't make them unless a program is known to use them
+	if conf.contextVersion() >= ContextV2 || conf.CORS != "" {
+		if route, err := kong.Router.GetRoute(); err == nil && route.Id != "" {
+			jqContext.Route = &RouteContext{ID: route.Id, Name: route.Name, Hosts: route.Hosts, Paths: route.Paths, Tags: route.Tags}
+		}
+
+		if consumer, err := kong.Client.GetConsumer(); err == nil && consumer.Id != "" {
+			jqContext.Consumer = &ConsumerContext{
+				ID:       consumer.Id,
+				Username: consumer.Username,
+				CustomID: consumer.CustomId,
+				Tags:     consumer.Tags,
+			}
+		}
+	}
+
+	return jqContext
+}
+
+// newRequestContext builds the request part of the context from the client request, without its body.
+func (conf Config) newRequestContext(kong *Kong, phase string) *RequestContext {
+	args, kwargs := lo.Must2(kong.Request.GetUriCaptures())
+
+	request := &RequestContext{
+		Method:      lo.Must(kong.Request.GetMethod()),
+		Path:        lo.Must(kong.Request.GetPath()),
+		Args:        lo.Map(args, func(s []byte, _ int) string { return string(s) }),
+		Kwargs:      lo.MapValues(kwargs, func(s []byte, _ string) string { return string(s) }),
+		QueryParams: lo.Must(kong.Request.GetQuery(-1)),
+		RawQuery:    lo.Must(kong.Request.GetRawQuery()),
+	}
+
+	if phase == PhaseAccess || conf.contextVersion() >= ContextV2 {
+		request.Headers = conf.normalizeHeaders(lo.Must(kong.Request.GetHeaders(-1)))
+	}
+
+	// the request body isn't available anymore in the response phase
+	if conf.contextVersion() >= ContextV2 {
+		request.BodyContext = &BodyContext{}
+	}
+
+	return request
+}
+
+// Arguments converts the context into the values jq works with.
+func (c JQContext) Arguments() map[string]any {
+	return jqValue(reflect.ValueOf(c)).(map[string]any)
+}
+
+// jqValue converts a Go value into the values jq works with: map[string]any for structs and
+// maps, []any for slices and int for integers. Values of type any are expected to be jq values already.
+func jqValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+
+		return v.Elem().Interface()
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+
+		return jqValue(v.Elem())
+	case reflect.Struct:
+		m := map[string]any{}
+		addStructFields(m, v)
+
+		return m
+	case reflect.Map:
+		m := make(map[string]any, v.Len())
+
+		for iter := v.MapRange(); iter.Next(); {
+			m[iter.Key().String()] = jqValue(iter.Value())
+		}
+
+		return m
+	case reflect.Slice:
+		s := make([]any, v.Len())
+
+		for i := range s {
+			s[i] = jqValue(v.Index(i))
+		}
+
+		return s
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int())
+	default:
+		return v.Interface()
+	}
+}
+
+func addStructFields(m map[string]any, v reflect.Value) {
+	for i := range v.NumField() {
+		field, value := v.Type().Field(i), v.Field(i)
+
+		if field.Anonymous {
+			if !value.IsNil() {
+				addStructFields(m, value.Elem())
+			}
+
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		if options == "omitempty" && isNil(value) {
+			continue
+		}
+
+		m[name] = jqValue(value)
+	}
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// ContextSchema returns the JSON schema of the context of the given version, for editors to
+// autocomplete the programs.
+func ContextSchema(version int) map[string]any {
+	schema := typeSchema(reflect.TypeOf(JQContext{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "kong-jq-plugin jq context"
+
+	properties := schema["properties"].(map[string]any)
+
+	if version >= ContextV2 {
+		properties["context_version"] = lo.Assign(properties["context_version"].(map[string]any), map[string]any{"const": version})
+		schema["required"] = []string{"context_version", "request"}
+	} else {
+		delete(properties, "context_version")
+		schema["required"] = []string{"request"}
+	}
+
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		properties := map[string]any{}
+		addStructProperties(properties, t)
+
+		return map[string]any{"type": "object", "properties": properties}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	default:
+		return map[string]any{}
+	}
+}
+
+func addStructProperties(properties map[string]any, t reflect.Type) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+
+		if field.Anonymous {
+			addStructProperties(properties, field.Type.Elem())
+
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+
+		schema := typeSchema(field.Type)
+		if description := field.Tag.Get("description"); description != "" {
+			schema["description"] = description
+		}
+
+		properties[name] = schema
+	}
+}
+
+// runSchemaCommand prints the JSON schema of the jq context.
+//
+//	kong-jq-plugin schema --context-version 2 > context.schema.json
+func runSchemaCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("schema", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	version := flags.Int("context-version", ContextV2, "the context version, 1 or 2")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *version != ContextV1 && *version != ContextV2 {
+		fmt.Fprintf(stderr, "unknown context version %d\n", *version)
+
+		return 2
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	lo.Must0(encoder.Encode(ContextSchema(*version)))
+
+	return 0
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/samber/lo"
+)
+
+var corsSharedKey = "kong_jq_cors" // kong.ctx.shared key passing the CORS headers over to the response phase
+
+// CORS is the result of the cors program once coerced.
+type CORS struct {
+	AllowOrigin  string   `json:"allow_origin"`
+	AllowMethods []string `json:"allow_methods"`
+	AllowHeaders []string `json:"allow_headers"`
+	MaxAge       *int     `json:"max_age"` // not sent when nil
+	Credentials  bool     `json:"credentials"`
+}
+
+// evalCORS runs the cors program, returning nil when it returns null or a null allow_origin, that
+// is when the origin isn't allowed. The error is a *FieldError.
+func (conf Config) evalCORS(ctx context.Context, arguments map[string]any) (*CORS, error) {
+	next, ok := runQuery(ctx, conf, PhaseAccess, FieldCORS, conf.CORS, arguments)
+	if !ok || next == nil {
+		return nil, nil
+	}
+
+	if err, ok := next.(error); ok {
+		return nil, &FieldError{Message: ErrorCORS, Err: err}
+	}
+
+	m, ok := next.(map[string]any)
+	if !ok {
+		return nil, &FieldError{Message: ErrorCORSResult}
+	}
+
+	if m["allow_origin"] == nil {
+		return nil, nil
+	}
+
+	cors := &CORS{}
+
+	if cors.AllowOrigin, ok = m["allow_origin"].(string); !ok {
+		return nil, &FieldError{Message: ErrorCORSResult}
+	}
+
+	errs := []string{} // by key, all the invalid keys are reported at once
+
+	for _, k := range []string{"allow_methods", "allow_headers"} {
+		values, ok := corsList(m[k])
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s is %s", k, gojq.TypeOf(m[k])))
+		}
+
+		if k == "allow_methods" {
+			cors.AllowMethods = values
+		} else {
+			cors.AllowHeaders = values
+		}
+	}
+
+	switch maxAge := m["max_age"].(type) {
+	case nil:
+	case int:
+		cors.MaxAge = &maxAge
+	case float64:
+		cors.MaxAge = lo.ToPtr(int(maxAge))
+	default:
+		errs = append(errs, fmt.Sprintf("max_age is %s", gojq.TypeOf(maxAge)))
+	}
+
+	cors.Credentials = truthy(m["credentials"])
+
+	if len(errs) > 0 {
+		return nil, &FieldError{Message: ErrorCORSValue, Err: errors.New(strings.Join(errs, ", "))}
+	}
+
+	return cors, nil
+}
+
+// corsList converts the methods or the headers of a cors result: a list of strings, a string
+// such as "GET, POST", or null.
+func corsList(v any) ([]string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{v}, true
+	case []any:
+		values := make([]string, 0, len(v))
+
+		for _, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, false
+			}
+
+			values = append(values, s)
+		}
+
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+// headers returns the CORS headers of a preflight response, or of an actual response which only
+// gets the origin and credentials ones.
+func (c *CORS) headers(preflight bool) map[string][]string {
+	headers := map[string][]string{"Access-Control-Allow-Origin": {c.AllowOrigin}}
+
+	if c.Credentials {
+		headers["Access-Control-Allow-Credentials"] = []string{"true"}
+	}
+
+	// the response depends on the origin unless any origin gets it
+	if c.AllowOrigin != "*" {
+		headers["Vary"] = []string{"Origin"}
+	}
+
+	if !preflight {
+		return headers
+	}
+
+	if len(c.AllowMethods) > 0 {
+		headers["Access-Control-Allow-Methods"] = []string{strings.Join(c.AllowMethods, ", ")}
+	}
+
+	if len(c.AllowHeaders) > 0 {
+		headers["Access-Control-Allow-Headers"] = []string{strings.Join(c.AllowHeaders, ", ")}
+	}
+
+	if c.MaxAge != nil {
+		headers["Access-Control-Max-Age"] = []string{strconv.Itoa(*c.MaxAge)}
+	}
+
+	return headers
+}
+
+// isPreflight tells whether the request is a CORS preflight request.
+func isPreflight(kong *Kong) bool {
+	origin, _ := kong.Request.GetHeader("origin")
+	requestMethod, _ := kong.Request.GetHeader("access-control-request-method")
+
+	return lo.Must(kong.Request.GetMethod()) == http.MethodOptions && origin != "" && requestMethod != ""
+}
+
+// withCORSHeaders adds CORS headers to response headers, whatever the case of their names. Vary is
+// appended to rather than replaced.
+func withCORSHeaders(headers, corsHeaders map[string][]string) map[string][]string {
+	merged := maps.Clone(headers)
+
+	for _, k := range slices.Sorted(maps.Keys(corsHeaders)) {
+		kept := []string{}
+
+		for existing := range headers {
+			if strings.EqualFold(existing, k) {
+				if k == "Vary" {
+					kept = append(kept, headers[existing]...)
+				}
+
+				delete(merged, existing)
+			}
+		}
+
+		merged[k] = append(kept, corsHeaders[k]...)
+	}
+
+	return merged
+}
+
+// setCORSHeaders adds CORS headers to the response as it is, appending to Vary.
+func setCORSHeaders(kong *Kong, corsHeaders map[string][]string) error {
+	for _, k := range slices.Sorted(maps.Keys(corsHeaders)) {
+		set := lo.Ternary(k == "Vary", kong.Response.AddHeader, kong.Response.SetHeader)
+
+		for _, value := range corsHeaders[k] {
+			if err := set(k, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func saveCORSHeaders(kong *Kong, corsHeaders map[string][]string) error {
+	return kong.Ctx.SetShared(corsSharedKey, string(lo.Must(json.Marshal(corsHeaders))))
+}
+
+func loadCORSHeaders(kong *Kong) map[string][]string {
+	corsHeaders := map[string][]string{}
+
+	s, err := kong.Ctx.GetSharedString(corsSharedKey)
+	if err != nil || s == "" {
+		return corsHeaders
+	}
+
+	if err := json.Unmarshal([]byte(s), &corsHeaders); err != nil {
+		return map[string][]string{}
+	}
+
+	return corsHeaders
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	DebugOutputHeaders = "headers"
+	DebugOutputBody    = "body"
+)
+
+var DebugHeader = "X-Kong-Jq-Debug" // the default request header carrying the debug secret, and the response debug header
+
+var (
+	debugKey       = "debug"
+	debugSharedKey = "kong_jq_debug" // kong.ctx.shared key passing the access phase trace over to the response phase
+)
+
+// debugTrace collects the jq contexts and program outputs of a request when debug is requested.
+type debugTrace struct {
+	Inputs   map[string]json.RawMessage `json:"inputs"` // the jq context of each phase, as its first program saw it
+	Programs []debugProgram             `json:"programs"`
+}
+
+type debugProgram struct {
+	Phase      string  `json:"phase"`
+	Field      string  `json:"field"`
+	Output     any     `json:"output,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+func (conf Config) debugRequested(kong *Kong) bool {
+	if !conf.Debug || conf.DebugSecret == "" {
+		return false
+	}
+
+	value, err := kong.Request.GetHeader(lo.Ternary(conf.DebugHeader != "", conf.DebugHeader, DebugHeader))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(value), []byte(conf.DebugSecret)) == 1
+}
+
+// ContextWithDebug attaches a debug trace to the context, picking up the one the access phase
+// left in kong.ctx.shared if any.
+func ContextWithDebug(ctx context.Context, kong *Kong) (context.Context, *debugTrace) {
+	trace := &debugTrace{Inputs: map[string]json.RawMessage{}}
+
+	if previous, err := kong.Ctx.GetSharedString(debugSharedKey); err == nil && previous != "" {
+		_ = json.Unmarshal([]byte(previous), trace)
+	}
+
+	return context.WithValue(ctx, debugKey, trace), trace
+}
+
+func debugFromContext(ctx context.Context) *debugTrace {
+	trace, _ := ctx.Value(debugKey).(*debugTrace)
+
+	return trace
+}
+
+func (t *debugTrace) save(kong *Kong) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return kong.Ctx.SetShared(debugSharedKey, string(b))
+}
+
+// recordInput records the jq context of a phase, without the request headers carrying secrets as
+// the trace ends up in the response.
+func (t *debugTrace) recordInput(phase string, input any, redactedHeaders []string) {
+	if _, ok := t.Inputs[phase]; ok {
+		return
+	}
+
+	// marshalled right away as the programs update the context as they go
+	if b, err := json.Marshal(redactInput(input, redactedHeaders)); err == nil {
+		t.Inputs[phase] = b
+	}
+}
+
+// debugRedactedHeaders lists the request headers left out of the debug trace: the debug one and
+// the credentials.
+func (conf Config) debugRedactedHeaders() []string {
+	return []string{
+		lo.Ternary(conf.DebugHeader != "", conf.DebugHeader, DebugHeader),
+		"Authorization",
+		"Proxy-Authorization",
+		"Cookie",
+	}
+}
+
+// redactInput returns a copy of a jq context without the given request headers, whatever the case
+// of their names.
+func redactInput(input any, redactedHeaders []string) any {
+	arguments, ok := input.(map[string]any)
+	if !ok {
+		return input
+	}
+
+	request, ok := arguments["request"].(map[string]any)
+	if !ok {
+		return input
+	}
+
+	headers, ok := request["headers"].(map[string]any)
+	if !ok {
+		return input
+	}
+
+	return lo.Assign(arguments, map[string]any{
+		"request": lo.Assign(request, map[string]any{"headers": omitHeaders(headers, redactedHeaders)}),
+	})
+}
+
+func omitHeaders(headers map[string]any, names []string) map[string]any {
+	return lo.OmitBy(headers, func(k string, _ any) bool {
+		return lo.SomeBy(names, func(name string) bool { return strings.EqualFold(k, name) })
+	})
+}
+
+// recordProgram records the output of a program, the request headers program one without the
+// headers carrying secrets.
+func (t *debugTrace) recordProgram(phase, field string, next any, ok bool, elapsed time.Duration, redactedHeaders []string) {
+	program := debugProgram{
+		Phase:      phase,
+		Field:      field,
+		DurationMs: float64(elapsed.Microseconds()) / 1000,
+	}
+
+	if !ok {
+		program.Error = OutcomeNoResult
+	} else if err, isErr := next.(error); isErr {
+		program.Error = err.Error()
+	} else if headers, isMap := next.(map[string]any); isMap && field == FieldRequestHeaders {
+		program.Output = omitHeaders(headers, redactedHeaders)
+	} else {
+		program.Output = next
+	}
+
+	t.Programs = append(t.Programs, program)
+}
+
+// headerValues renders the trace as X-Kong-Jq-Debug header values, a compact JSON document each.
+func (t *debugTrace) headerValues() []string {
+	values := []string{}
+
+	for _, phase := range []string{PhaseAccess, PhaseResponse} {
+		if input, ok := t.Inputs[phase]; ok {
+			values = append(values, string(lo.Must(json.Marshal(map[string]any{"phase": phase, "input": input}))))
+		}
+	}
+
+	for _, program := range t.Programs {
+		values = append(values, string(lo.Must(json.Marshal(program))))
+	}
+
+	return values
+}
+
+// pass sets the status and the headers of the response, leaving its body to the upstream one, and
+// adds the debug trace when debug was requested. The trace replacing the body, it ends the request
+// with exit instead when debug_output is body.
+func pass(ctx context.Context, conf Config, kong *Kong, status int, body []byte, headers map[string][]string) error {
+	trace := debugFromContext(ctx)
+
+	if trace != nil && conf.DebugOutput == DebugOutputBody {
+		if body == nil { // over the body limit, it wasn't read
+			body = lo.Must(kong.ServiceResponse.GetRawBody())
+		}
+
+		exit(ctx, conf, kong, status, body, headers)
+
+		return nil
+	}
+
+	if trace != nil {
+		headers = lo.Assign(headers, map[string][]string{DebugHeader: trace.headerValues()})
+	}
+
+	if err := kong.Response.SetStatus(status); err != nil {
+		return err
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(headers)) {
+		for i, value := range headers[k] {
+			set := lo.Ternary(i == 0, kong.Response.SetHeader, kong.Response.AddHeader)
+
+			if err := set(k, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// exit ends the request like kong.Response.Exit does, adding the debug trace to the response
+// when debug was requested.
+func exit(ctx context.Context, conf Config, kong *Kong, status int, body []byte, headers map[string][]string) {
+	trace := debugFromContext(ctx)
+
+	switch {
+	case trace == nil:
+		kong.Response.Exit(status, body, headers)
+	case conf.DebugOutput == DebugOutputBody:
+		envelope := lo.Must(json.Marshal(map[string]any{
+			"status_code": status,
+			"headers":     headers,
+			"body":        string(body),
+			"debug":       trace,
+		}))
+
+		kong.Response.Exit(status, envelope, map[string][]string{"Content-Type": {"application/json"}})
+	default:
+		kong.Response.Exit(status, body, lo.Assign(headers, map[string][]string{DebugHeader: trace.headerValues()}))
+	}
+}
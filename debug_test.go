@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestDebugRedactsSecrets checks that the debug trace sent back in the response headers carries
+// neither the debug secret nor the credentials of the request.
+func TestDebugRedactsSecrets(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		Path:           `"/new" + .request.path`,
+		RequestHeaders: `.request.headers`,
+		Debug:          true,
+		DebugSecret:    "topsecret",
+	}
+
+	_, response, err := conf.Play(HTTPRequest{
+		Method: http.MethodGet,
+		Path:   "/users",
+		Headers: map[string][]string{
+			"X-Kong-Jq-Debug": {"topsecret"},
+			"Authorization":   {"Bearer abc"},
+			"Cookie":          {"session=1"},
+			"Accept":          {"application/json"},
+		},
+	}, func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{Status: http.StatusOK}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace := strings.Join(response.Headers["x-kong-jq-debug"], "\n")
+
+	if !strings.Contains(trace, "application/json") {
+		t.Fatalf("expected the trace to hold the request headers, got %s", trace)
+	}
+
+	for _, secret := range []string{"topsecret", "Bearer abc", "session=1"} {
+		if strings.Contains(trace, secret) {
+			t.Errorf("the debug trace leaks %q: %s", secret, trace)
+		}
+	}
+}
+
+// TestDebugKeepsResponse checks that a debug request gets the response a normal one gets when
+// the configuration doesn't transform responses, only with the debug headers added.
+func TestDebugKeepsResponse(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		Path:           `"/new" + .request.path`,
+		RequestHeaders: `.request.headers`,
+		Debug:          true,
+		DebugSecret:    "topsecret",
+	}
+
+	upstream := func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{
+			Status:  http.StatusOK,
+			Headers: map[string][]string{"Content-Type": {"application/json"}, "ETag": {`"v1"`}},
+			Body:    `{"id": 7}`,
+		}, nil
+	}
+
+	_, response, err := conf.Play(HTTPRequest{
+		Method:  http.MethodGet,
+		Path:    "/users",
+		Headers: map[string][]string{"X-Kong-Jq-Debug": {"topsecret"}},
+	}, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != http.StatusOK || response.Body != `{"id": 7}` {
+		t.Errorf("unexpected response %d %s", response.Status, response.Body)
+	}
+
+	for k, value := range map[string]string{"content-type": "application/json", "etag": `"v1"`} {
+		if firstValue(response.Headers, k) != value {
+			t.Errorf("expected the %s header to be %s, got %v", k, value, response.Headers[k])
+		}
+	}
+
+	if len(response.Headers["x-kong-jq-debug"]) == 0 {
+		t.Error("missing the debug headers")
+	}
+}
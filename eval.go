@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/Kong/go-pdk/entities"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// EvalResult is what the eval subcommand prints: the result of the field program once converted
+// the way the handlers use it, and the error messages the handlers would reply with.
+type EvalResult struct {
+	Field   string   `json:"field"`
+	Phase   string   `json:"phase"`
+	Skipped bool     `json:"skipped"` // the when predicate or the field one skipped the field
+	Result  any      `json:"result"`
+	Errors  []string `json:"errors"`
+}
+
+// fieldPhase returns the phase a field runs in, false when eval doesn't know about it.
+func fieldPhase(field string) (string, bool) {
+	switch field {
+	case FieldWhen, FieldCORS, FieldRedirect, FieldCacheKey, FieldSign:
+		return PhaseAccess, true
+	case FieldCacheTTL:
+		return PhaseResponse, true
+	}
+
+	for phase, fields := range PhaseFields {
+		if slices.Contains(fields, field) {
+			return phase, true
+		}
+	}
+
+	return "", false
+}
+
+// inputMultimap reads the query params or headers of an eval input, their values being strings
+// or lists of strings.
+func inputMultimap(v any) map[string][]string {
+	m, _ := v.(map[string]any)
+
+	multimap, err := coerceMultimap(m, "")
+	if err != nil {
+		return map[string][]string{}
+	}
+
+	return multimap.Values
+}
+
+// inputObject reads an object of an eval input into a context struct, leaving it empty when the
+// object doesn't fit.
+func inputObject(v any, target any) {
+	if b, err := json.Marshal(v); err == nil {
+		_ = json.Unmarshal(b, target)
+	}
+}
+
+// evalArguments builds the jq context of a phase from the eval input, the way the handlers build
+// it from the request and the response: the keys the input doesn't give get the values kong would
+// give them, the bodies are limited and decoded according to the configuration. It returns the
+// fake kong the context is built from, and the error message the handlers would reply with when
+// the bodies can't be processed.
+func (conf Config) evalArguments(logger *logrus.Entry, phase string, input map[string]any) (map[string]any, *Kong, string) {
+	inputRequest, _ := input["request"].(map[string]any)
+	inputResponse, _ := input["response"].(map[string]any)
+
+	method, _ := lo.ValueOr(inputRequest, "method", any("GET")).(string)
+	path, _ := lo.ValueOr(inputRequest, "path", any("/")).(string)
+	args, _ := inputRequest["args"].([]any)
+	kwargs, _ := inputRequest["kwargs"].(map[string]any)
+	rawQuery, _ := inputRequest["raw_query"].(string)
+
+	request := &fakeRequest{
+		request: HTTPRequest{
+			Method:   method,
+			Path:     path,
+			Query:    inputMultimap(inputRequest["query_params"]),
+			RawQuery: rawQuery,
+			Headers:  lowerKeys(inputMultimap(inputRequest["headers"])),
+		},
+		args:   lo.Map(args, func(v any, _ int) string { return scalarString(v) }),
+		kwargs: lo.MapValues(kwargs, func(v any, _ string) string { return scalarString(v) }),
+	}
+
+	response := &fakeServiceResponse{
+		response: HTTPResponse{
+			Status:  200,
+			Headers: lowerKeys(inputMultimap(inputResponse["headers"])),
+		},
+	}
+
+	if n, ok := inputResponse["status_code"].(float64); ok {
+		response.response.Status = int(n)
+	}
+
+	var (
+		consumer ConsumerContext
+		route    RouteContext
+	)
+
+	inputObject(input["consumer"], &consumer)
+	inputObject(input["route"], &route)
+
+	kong := &Kong{
+		Request:         request,
+		ServiceResponse: response,
+		Client: &fakeClient{
+			consumer: entities.Consumer{Id: consumer.ID, Username: consumer.Username, CustomId: consumer.CustomID, Tags: consumer.Tags},
+		},
+		Router: &fakeRouter{
+			route: entities.Route{Id: route.ID, Name: route.Name, Hosts: route.Hosts, Paths: route.Paths, Tags: route.Tags},
+		},
+	}
+
+	jqContext := conf.newContext(kong, phase)
+
+	if conf.JWT.enabled() {
+		jqContext.JWT = &JWTContext{}
+		inputObject(input["jwt"], jqContext.JWT)
+	}
+
+	if phase == PhaseAccess {
+		if conf.needsRequestBody() {
+			body, _ := inputRequest["body"].(string)
+
+			requestBody, truncated, ok := conf.limitBody(logger, []byte(body), len(body), conf.MaxRequestBodyBytes)
+			if !ok {
+				return nil, nil, ErrorRequestBodyTooLarge
+			}
+
+			jqContext.Request.BodyContext = &BodyContext{
+				Body:          requestBody,
+				BodyTruncated: truncated,
+				JSON:          conf.decodedBody(logger, kong.Request.GetHeader, requestBody, truncated),
+			}
+		}
+
+		return jqContext.Arguments(), kong, ""
+	}
+
+	body, _ := inputResponse["body"].(string)
+
+	responseBody, truncated, ok := conf.limitBody(logger, []byte(body), len(body), conf.MaxResponseBodyBytes)
+	if !ok {
+		return nil, nil, ErrorResponseBodyTooLarge
+	}
+
+	jqContext.Response = &ResponseContext{
+		StatusCode: response.response.Status,
+		Headers:    map[string][]string{}, // version 1 only uses them to decode the body
+		BodyContext: &BodyContext{
+			Body:          responseBody,
+			BodyTruncated: truncated,
+			JSON:          conf.decodedBody(logger, kong.ServiceResponse.GetHeader, responseBody, truncated),
+		},
+	}
+
+	if conf.contextVersion() >= ContextV2 {
+		jqContext.Response.Headers = conf.normalizeHeaders(lo.Must(kong.ServiceResponse.GetHeaders(-1)))
+	}
+
+	return jqContext.Arguments(), kong, ""
+}
+
+// Eval runs the program of a field against an eval input, as the handlers would.
+func (conf Config) Eval(field string, input map[string]any) (EvalResult, error) {
+	phase, ok := fieldPhase(field)
+	if !ok {
+		return EvalResult{}, fmt.Errorf("unknown field %q", field)
+	}
+
+	query := map[string]string{
+		FieldWhen:     conf.When,
+		FieldCORS:     conf.CORS,
+		FieldRedirect: conf.Redirect,
+		FieldCacheKey: conf.CacheKey,
+		FieldCacheTTL: conf.CacheTTL,
+		FieldSign:     conf.Sign.CanonicalString,
+	}[field]
+	if query == "" {
+		query = conf.fieldQuery(field)
+	}
+
+	if query == "" {
+		return EvalResult{}, fmt.Errorf("field %q isn't configured", field)
+	}
+
+	// a program that doesn't compile is an error of the configuration, not a result
+	if _, err := compileQuery(query); err != nil {
+		return EvalResult{}, fmt.Errorf("%s: %w", field, err)
+	}
+
+	result := EvalResult{Field: field, Phase: phase, Errors: []string{}}
+
+	ctx, logger := ContextWithLog(context.Background(), logrus.Fields{"app": "kong-jq", "field": field})
+
+	arguments, kong, message := conf.evalArguments(logger, phase, input)
+	if message != "" {
+		result.Errors = append(result.Errors, message)
+
+		return result, nil
+	}
+
+	if conf.When != "" && field != FieldWhen {
+		// the handlers evaluate it in the access phase, against the access phase context
+		whenArguments := arguments
+
+		if phase != PhaseAccess {
+			if whenArguments, _, message = conf.evalArguments(logger, PhaseAccess, input); message != "" {
+				result.Errors = append(result.Errors, message)
+
+				return result, nil
+			}
+		}
+
+		run, err := evalPredicate(ctx, conf, PhaseAccess, FieldWhen, conf.When, whenArguments)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %+v", ErrorWhen, err))
+
+			return result, nil
+		}
+
+		if !run {
+			result.Skipped = true
+
+			return result, nil
+		}
+	}
+
+	switch field {
+	case FieldWhen:
+		run, err := evalPredicate(ctx, conf, PhaseAccess, FieldWhen, query, arguments)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %+v", ErrorWhen, err))
+		}
+
+		result.Result = run
+	case FieldCORS:
+		cors, err := conf.evalCORS(ctx, arguments)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+
+			break
+		}
+
+		if cors != nil {
+			result.Result = cors.headers(isPreflight(kong))
+		}
+	case FieldRedirect:
+		location, status, err := conf.evalRedirect(ctx, kong, arguments)
+		if errors.Is(err, ErrRedirectLocation) {
+			result.Errors = append(result.Errors, ErrorRedirectLocation)
+
+			break
+		}
+
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+
+			break
+		}
+
+		if location != "" {
+			result.Result = map[string]any{"location": location, "status": status}
+		}
+	case FieldSign:
+		signingArguments, message := conf.evalSigningArguments(ctx, kong, arguments, input)
+		if message != "" {
+			result.Errors = append(result.Errors, message)
+
+			break
+		}
+
+		signature, err := conf.evalSignature(ctx, signingArguments)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+
+			break
+		}
+
+		result.Result = map[string]any{conf.headerName(conf.Sign.header()): signature}
+	case FieldCacheKey, FieldCacheTTL:
+		message := lo.Ternary(field == FieldCacheKey, ErrorCacheKey, ErrorCacheTTL)
+
+		next, ok := runQuery(ctx, conf, phase, field, query, arguments)
+		if err, isErr := next.(error); ok && isErr {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %+v", message, err))
+
+			break
+		}
+
+		if field == FieldCacheTTL {
+			result.Result = ttlSeconds(next).Seconds()
+		} else if key, ok := cacheKey(next); ok {
+			result.Result = key
+		}
+	default:
+		// the handlers evaluate the field predicates of the phase up front, against its context
+		skipped, err := conf.skippedFields(ctx, phase, arguments)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %+v", ErrorFieldWhen, err))
+
+			return result, nil
+		}
+
+		if message := conf.evalPrecedingFields(ctx, kong, phase, field, arguments, skipped); message != "" {
+			result.Errors = append(result.Errors, message)
+
+			return result, nil
+		}
+
+		// a nil body is one passed through over its size limit, its program doesn't run
+		body := arguments[lo.Ternary(phase == PhaseAccess, "request", "response")].(map[string]any)["body"]
+
+		if skipped[field] || ((field == FieldRequestBody || field == FieldResponseBody) && body == nil) {
+			result.Skipped = true
+
+			return result, nil
+		}
+
+		next, err := conf.evalField(ctx, phase, field, arguments)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+
+			return result, nil
+		}
+
+		if body, ok := next.(encodedBody); ok {
+			next = string(body.Bytes)
+		}
+
+		result.Result = next
+	}
+
+	return result, nil
+}
+
+// evalSigningArguments builds the context of the canonical_string program the way the access
+// handler does: the request programs run against a stand-in of the upstream request, whose headers
+// and body end up in the context. It returns the error message the handler would reply with when
+// a request program fails.
+func (conf Config) evalSigningArguments(ctx context.Context, kong *Kong, arguments, input map[string]any) (map[string]any, string) {
+	skipped, err := conf.skippedFields(ctx, PhaseAccess, arguments)
+	if err != nil {
+		return nil, fmt.Sprintf("%s: %+v", ErrorFieldWhen, err)
+	}
+
+	inputRequest, _ := input["request"].(map[string]any)
+	body, _ := inputRequest["body"].(string)
+
+	evalServiceRequest(kong)
+
+	headers, upstreamBody, err := conf.rewriteRequest(ctx, kong, arguments, skipped, body)
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	return conf.signingArguments(arguments, headers, upstreamBody), ""
+}
+
+// evalPrecedingFields runs the programs the handlers run before a field of PhaseFields: the access
+// ones rewrite the request of the context as the access handler does, through the same path, while
+// the response ones leave the context alone and can only fail. It returns the error message the
+// handler would reply with when one of them fails.
+func (conf Config) evalPrecedingFields(
+	ctx context.Context,
+	kong *Kong,
+	phase, field string,
+	arguments map[string]any,
+	skipped map[string]bool,
+) string {
+	fields := PhaseFields[phase]
+	index := slices.Index(fields, field)
+
+	if phase == PhaseAccess {
+		// the field and the ones after it are left out, as if they were skipped
+		preceding := maps.Clone(skipped)
+		for _, f := range fields[index:] {
+			preceding[f] = true
+		}
+
+		evalServiceRequest(kong)
+
+		if _, _, err := conf.rewriteRequest(ctx, kong, arguments, preceding, nil); err != nil {
+			return err.Error()
+		}
+
+		return ""
+	}
+
+	for _, f := range fields[:index] {
+		if conf.fieldQuery(f) == "" || skipped[f] {
+			continue
+		}
+
+		if _, err := conf.evalField(ctx, phase, f, arguments); err != nil {
+			return err.Error()
+		}
+	}
+
+	return ""
+}
+
+// evalServiceRequest gives the fake kong of eval a stand-in of the upstream request, the incoming
+// request until the request programs rewrite it.
+func evalServiceRequest(kong *Kong) {
+	serviceRequest := &fakeServiceRequest{request: kong.Request.(*fakeRequest).request}
+	serviceRequest.request.Headers = maps.Clone(serviceRequest.request.Headers)
+	kong.ServiceRequest = serviceRequest
+}
+
+// runEvalCommand runs the program of a field against a jq context, printing its result and the
+// error messages the handlers would reply with. It exits with 1 when some would.
+//
+//	kong-jq-plugin eval --field response_body --config plugin.yaml --input context.json
+func runEvalCommand(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	field := flags.String("field", "", "the field whose program runs: method, path, query_params, request_headers, request_body, response_headers, status_code, response_body, when, cors, redirect, cache_key, cache_ttl or sign")
+	configPath := flags.String("config", "", "the plugin configuration file, YAML or JSON")
+	inputPath := flags.String("input", "", "the jq context, YAML or JSON, as the plugin documentation shows it")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *field == "" || *configPath == "" || *inputPath == "" {
+		fmt.Fprintln(stderr, "usage: kong-jq-plugin eval --field response_body --config plugin.yaml --input context.json")
+
+		return 2
+	}
+
+	conf, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+
+		return 2
+	}
+
+	var input map[string]any
+
+	if err := loadYAML(*inputPath, &input); err != nil {
+		fmt.Fprintln(stderr, err)
+
+		return 2
+	}
+
+	result, err := conf.Eval(*field, input)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+
+		return 2
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	lo.Must0(encoder.Encode(result))
+
+	return lo.Ternary(len(result.Errors) > 0, 1, 0)
+}
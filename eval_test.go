@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestEvalWhenResponseField checks that eval evaluates the when predicate of a response field
+// against the access phase context, as the handlers do, version 1 response contexts lacking the
+// request headers.
+func TestEvalWhenResponseField(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		When:       `.request.headers["x-legacy"] == ["true"]`,
+		StatusCode: `201`,
+	}
+
+	result, err := conf.Eval(FieldStatusCode, map[string]any{
+		"request": map[string]any{"headers": map[string]any{"x-legacy": []any{"true"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Skipped || len(result.Errors) > 0 {
+		t.Fatalf("expected the status code program to run, got %+v", result)
+	}
+
+	_, response, err := conf.Play(HTTPRequest{
+		Method:  http.MethodGet,
+		Path:    "/",
+		Headers: map[string][]string{"x-legacy": {"true"}},
+	}, func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{Status: http.StatusOK}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, ok := result.Result.(Status); !ok || status.Code != response.Status {
+		t.Errorf("expected eval to give the status the plugin replies with %d, got %+v", response.Status, result.Result)
+	}
+}
+
+// TestEvalSign checks that eval signs the request the upstream gets, as the access handler does,
+// rather than the incoming one.
+func TestEvalSign(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf, err := LoadConfig(filepath.Join("testdata", "sign", "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := conf.Eval(FieldSign, map[string]any{
+		"request": map[string]any{
+			"method":       http.MethodPost,
+			"path":         "/orders",
+			"query_params": map[string]any{"debug": "1"},
+			"headers":      map[string]any{"host": "api.example.com", "content-type": "application/json"},
+			"body":         `{"id": 42}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamRequest, _, err := conf.Play(HTTPRequest{
+		Method:   http.MethodPost,
+		Path:     "/orders",
+		RawQuery: "debug=1",
+		Headers:  map[string][]string{"host": {"api.example.com"}, "content-type": {"application/json"}},
+		Body:     `{"id": 42}`,
+	}, func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{Status: http.StatusCreated}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]any{"x-signature": firstValue(upstreamRequest.Headers, "x-signature")}
+
+	if len(result.Errors) > 0 || !reflect.DeepEqual(result.Result, expected) {
+		t.Errorf("expected eval to give the signature the upstream gets %v, got %+v", expected, result)
+	}
+}
+
+// TestEvalPrecedingFields checks that eval runs a field against the request the programs before
+// it in the access phase rewrote, as the access handler does.
+func TestEvalPrecedingFields(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		Method:      `"POST"`,
+		Path:        `"/" + .request.method`,
+		QueryParams: `{method: .request.method, path: .request.path}`,
+	}
+
+	for field, expected := range map[string]any{
+		FieldMethod:      "POST",
+		FieldPath:        "/POST",
+		FieldQueryParams: Multimap{Values: map[string][]string{"method": {"POST"}, "path": {"/POST"}}, Removed: []string{}},
+	} {
+		result, err := conf.Eval(field, map[string]any{"request": map[string]any{"method": http.MethodGet, "path": "/users"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Errors) > 0 || !reflect.DeepEqual(result.Result, expected) {
+			t.Errorf("expected %s to give %+v, got %+v", field, expected, result)
+		}
+	}
+}
+
+// TestEvalBodyPassthrough checks that eval skips the response body program of a body passed
+// through over its size limit, as the response handler does.
+func TestEvalBodyPassthrough(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		ResponseBody:         `{id: .response.json.id}`,
+		DecodeBodies:         true,
+		MaxResponseBodyBytes: 8,
+	}
+
+	result, err := conf.Eval(FieldResponseBody, map[string]any{
+		"response": map[string]any{
+			"headers": map[string]any{"content-type": "application/json"},
+			"body":    `{"id": 7, "name": "Ada"}`,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Skipped || len(result.Errors) > 0 || result.Result != nil {
+		t.Errorf("expected the response body program to be skipped, got %+v", result)
+	}
+}
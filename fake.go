@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Kong/go-pdk/entities"
+	"github.com/samber/lo"
+)
+
+// HTTPRequest is a request as the plugin sees it, the client one or the one sent to the upstream.
+type HTTPRequest struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   map[string][]string `json:"query,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"` // keys are lower-cased, as kong does
+	Body    string              `json:"body,omitempty"`
+
+	RawQuery string `json:"raw_query,omitempty"` // the query string as it's sent, Query encoded when it's empty
+}
+
+// rawQuery returns the query string of the request.
+func (r HTTPRequest) rawQuery() string {
+	if r.RawQuery != "" {
+		return r.RawQuery
+	}
+
+	return url.Values(r.Query).Encode()
+}
+
+// HTTPResponse is a response as the plugin sees it, the upstream one or the one sent to the client.
+type HTTPResponse struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"` // keys are lower-cased, as kong does
+	Body    string              `json:"body,omitempty"`
+}
+
+var ErrNotAString = errors.New("shared value is not a string")
+
+// lowerKeys copies a multimap, lower-casing its keys and merging the values of the keys it folds.
+func lowerKeys(m map[string][]string) map[string][]string {
+	lowered := make(map[string][]string, len(m))
+
+	for k, v := range m {
+		lowered[strings.ToLower(k)] = append(lowered[strings.ToLower(k)], v...)
+	}
+
+	return lowered
+}
+
+func firstValue(headers map[string][]string, name string) string {
+	if values := headers[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+type fakeRequest struct {
+	request HTTPRequest
+	args    []string          // the unnamed URI captures
+	kwargs  map[string]string // the named URI captures
+}
+
+// GetForwardedScheme is http, unless the request has an X-Forwarded-Proto header.
+func (r *fakeRequest) GetForwardedScheme() (string, error) {
+	if scheme := firstValue(r.request.Headers, "x-forwarded-proto"); scheme != "" {
+		return scheme, nil
+	}
+
+	return "http", nil
+}
+
+func (r *fakeRequest) GetForwardedHost() (string, error) {
+	host, _, err := net.SplitHostPort(firstValue(r.request.Headers, "host"))
+	if err != nil {
+		return firstValue(r.request.Headers, "host"), nil
+	}
+
+	return host, nil
+}
+
+// GetForwardedPort is the port of the Host header, the default one of the scheme without it.
+func (r *fakeRequest) GetForwardedPort() (int, error) {
+	if _, port, err := net.SplitHostPort(firstValue(r.request.Headers, "host")); err == nil {
+		return strconv.Atoi(port)
+	}
+
+	scheme, _ := r.GetForwardedScheme()
+
+	return lo.Ternary(scheme == "https", 443, 80), nil
+}
+
+func (r *fakeRequest) GetMethod() (string, error) { return r.request.Method, nil }
+func (r *fakeRequest) GetPath() (string, error)   { return r.request.Path, nil }
+
+func (r *fakeRequest) GetQuery(int) (map[string][]string, error) {
+	return maps.Clone(r.request.Query), nil
+}
+
+func (r *fakeRequest) GetRawQuery() (string, error) { return r.request.rawQuery(), nil }
+
+func (r *fakeRequest) GetHeader(k string) (string, error) {
+	return firstValue(r.request.Headers, k), nil
+}
+
+func (r *fakeRequest) GetHeaders(int) (map[string][]string, error) {
+	return maps.Clone(r.request.Headers), nil
+}
+
+func (r *fakeRequest) GetRawBody() ([]byte, error) { return []byte(r.request.Body), nil }
+
+func (r *fakeRequest) GetUriCaptures() ([][]byte, map[string][]byte, error) {
+	return lo.Map(r.args, func(s string, _ int) []byte { return []byte(s) }),
+		lo.MapValues(r.kwargs, func(s string, _ string) []byte { return []byte(s) }),
+		nil
+}
+
+// fakeServiceRequest starts as a copy of the client request, as kong forwards it as is by default.
+type fakeServiceRequest struct {
+	request HTTPRequest
+}
+
+func (r *fakeServiceRequest) SetMethod(method string) error { r.request.Method = method; return nil }
+func (r *fakeServiceRequest) SetPath(path string) error     { r.request.Path = path; return nil }
+
+func (r *fakeServiceRequest) SetQuery(query map[string][]string) error {
+	r.request.Query = maps.Clone(query)
+	r.request.RawQuery = ""
+
+	return nil
+}
+
+func (r *fakeServiceRequest) SetRawQuery(query string) error {
+	r.request.Query, _ = url.ParseQuery(query)
+	r.request.RawQuery = query
+
+	return nil
+}
+
+func (r *fakeServiceRequest) SetHeader(name string, value string) error {
+	r.request.Headers[strings.ToLower(name)] = []string{value}
+
+	return nil
+}
+
+func (r *fakeServiceRequest) AddHeader(name string, value string) error {
+	r.request.Headers[strings.ToLower(name)] = append(r.request.Headers[strings.ToLower(name)], value)
+
+	return nil
+}
+
+func (r *fakeServiceRequest) ClearHeader(name string) error {
+	delete(r.request.Headers, strings.ToLower(name))
+
+	return nil
+}
+
+// SetRawBody sets the Content-Length along with the body, as kong does.
+func (r *fakeServiceRequest) SetRawBody(body string) error {
+	r.request.Body = body
+	r.request.Headers["content-length"] = []string{strconv.Itoa(len(body))}
+
+	return nil
+}
+
+// fakeResponse is the response sent to the client, the upstream one until the plugin exits.
+type fakeResponse struct {
+	response HTTPResponse
+	exited   bool
+}
+
+func (r *fakeResponse) GetHeaders(int) (map[string][]string, error) {
+	return maps.Clone(r.response.Headers), nil
+}
+
+func (r *fakeResponse) SetStatus(status int) error { r.response.Status = status; return nil }
+
+func (r *fakeResponse) SetHeader(k string, v string) error {
+	r.response.Headers[strings.ToLower(k)] = []string{v}
+
+	return nil
+}
+
+func (r *fakeResponse) AddHeader(k string, v string) error {
+	r.response.Headers[strings.ToLower(k)] = append(r.response.Headers[strings.ToLower(k)], v)
+
+	return nil
+}
+
+func (r *fakeResponse) ClearHeader(k string) error {
+	delete(r.response.Headers, strings.ToLower(k))
+
+	return nil
+}
+
+// Exit replaces the status and the body, the headers it's given being set over the current ones.
+func (r *fakeResponse) Exit(status int, body []byte, headers map[string][]string) {
+	maps.Copy(r.response.Headers, lowerKeys(headers))
+	r.response.Headers["content-length"] = []string{strconv.Itoa(len(body))}
+	r.response.Status = status
+	r.response.Body = string(body)
+	r.exited = true
+}
+
+type fakeServiceResponse struct {
+	response HTTPResponse
+}
+
+func (r *fakeServiceResponse) GetStatus() (int, error) { return r.response.Status, nil }
+
+func (r *fakeServiceResponse) GetHeader(name string) (string, error) {
+	return firstValue(r.response.Headers, name), nil
+}
+
+func (r *fakeServiceResponse) GetHeaders(int) (map[string][]string, error) {
+	return maps.Clone(r.response.Headers), nil
+}
+
+func (r *fakeServiceResponse) GetRawBody() ([]byte, error) { return []byte(r.response.Body), nil }
+
+type fakeCtx struct {
+	shared map[string]any
+}
+
+func (c *fakeCtx) SetShared(k string, value any) error {
+	c.shared[k] = value
+
+	return nil
+}
+
+func (c *fakeCtx) GetSharedAny(k string) (any, error) { return c.shared[k], nil }
+
+func (c *fakeCtx) GetSharedString(k string) (string, error) {
+	value, ok := c.shared[k].(string)
+	if !ok && c.shared[k] != nil {
+		return "", ErrNotAString
+	}
+
+	return value, nil
+}
+
+// fakeClient has the consumer the request is authenticated as, none when its id is empty.
+type fakeClient struct {
+	consumer entities.Consumer
+}
+
+func (c *fakeClient) GetConsumer() (entities.Consumer, error) { return c.consumer, nil }
+
+// fakeRouter has the route matched by the request, none when its id is empty.
+type fakeRouter struct {
+	route entities.Route
+}
+
+func (r *fakeRouter) GetRoute() (entities.Route, error) { return r.route, nil }
+
+// Play runs a request through the plugin without kong: the access phase, the upstream, then the
+// response phase. The upstream gets the request as the access phase leaves it, it isn't called
+// when the access phase ends the request, in which case the returned upstream request is nil.
+func (conf Config) Play(
+	request HTTPRequest,
+	upstream func(HTTPRequest) (HTTPResponse, error),
+) (*HTTPRequest, HTTPResponse, error) {
+	request.Headers = lowerKeys(request.Headers)
+	if request.Query == nil {
+		request.Query, _ = url.ParseQuery(request.RawQuery)
+	}
+
+	serviceRequest := &fakeServiceRequest{request: request}
+	serviceRequest.request.Query = maps.Clone(request.Query)
+	serviceRequest.request.Headers = maps.Clone(request.Headers)
+
+	response := &fakeResponse{response: HTTPResponse{Headers: map[string][]string{}}}
+
+	kong := &Kong{
+		Request:         &fakeRequest{request: request},
+		ServiceRequest:  serviceRequest,
+		Response:        response,
+		ServiceResponse: &fakeServiceResponse{},
+		Ctx:             &fakeCtx{shared: map[string]any{}},
+		Client:          &fakeClient{},
+		Router:          &fakeRouter{},
+	}
+
+	conf.access(kong)
+
+	if response.exited {
+		return nil, response.response, nil
+	}
+
+	upstreamResponse, err := upstream(serviceRequest.request)
+	if err != nil {
+		return &serviceRequest.request, HTTPResponse{}, err
+	}
+
+	upstreamResponse.Headers = lowerKeys(upstreamResponse.Headers)
+
+	kong.ServiceResponse = &fakeServiceResponse{response: upstreamResponse}
+	response.response = upstreamResponse
+	response.response.Headers = maps.Clone(upstreamResponse.Headers)
+
+	conf.response(kong)
+
+	return &serviceRequest.request, response.response, nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// FieldError is the failure of a field program, Message being the error message the handlers
+// reply with.
+type FieldError struct {
+	Message string
+	Err     error
+}
+
+func (e *FieldError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %+v", e.Message, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// fieldErrorMessages are the error messages of the fields: when their program doesn't return
+// anything, when it fails, and when its result can't be used.
+var fieldErrorMessages = map[string][3]string{
+	FieldMethod:          {ErrorMethodResult, ErrorMethod, ErrorMethodString},
+	FieldPath:            {ErrorPathResult, ErrorPath, ErrorPathString},
+	FieldQueryParams:     {ErrorQueryParamsResult, ErrorQueryParams, ErrorQueryParamsMap},
+	FieldRequestHeaders:  {ErrorHeadersResult, ErrorHeaders, ErrorHeadersMap},
+	FieldRequestBody:     {ErrorRequestBodyResult, ErrorRequestBody, ErrorRequestBody},
+	FieldResponseHeaders: {ErrorHeadersResult, ErrorHeaders, ErrorHeadersMap},
+	FieldStatusCode:      {ErrorStatusCodeResult, ErrorStatusCode, ErrorStatusCodeInteger},
+	FieldResponseBody:    {ErrorResponseBodyResult, ErrorResponseBody, ErrorResponseBody},
+}
+
+// fieldQuery returns the jq query of a field of PhaseFields.
+func (conf Config) fieldQuery(field string) string {
+	return map[string]string{
+		FieldMethod:          conf.Method,
+		FieldPath:            conf.Path,
+		FieldQueryParams:     conf.QueryParams,
+		FieldRequestHeaders:  conf.RequestHeaders,
+		FieldRequestBody:     conf.RequestBody,
+		FieldResponseHeaders: conf.ResponseHeaders,
+		FieldStatusCode:      conf.StatusCode,
+		FieldResponseBody:    conf.ResponseBody,
+	}[field]
+}
+
+// encodedBody is the result of a body program, as jq returned it and encoded in the output format.
+type encodedBody struct {
+	Value any
+	Bytes []byte
+}
+
+// evalField runs the program of a field of PhaseFields and converts its result the way the
+// handlers use it: a string for the method and the path, a Multimap for the headers, a Multimap or
+// a raw query string for the query params, a Status for the status code and an encodedBody for the
+// bodies. The error is a *FieldError.
+func (conf Config) evalField(ctx context.Context, phase, field string, arguments map[string]any) (any, error) {
+	messages := fieldErrorMessages[field]
+
+	next, ok := runQuery(ctx, conf, phase, field, conf.fieldQuery(field), arguments)
+	if !ok {
+		return nil, &FieldError{Message: messages[0]}
+	}
+
+	if err, ok := next.(error); ok {
+		return nil, &FieldError{Message: messages[1], Err: err}
+	}
+
+	switch field {
+	case FieldMethod, FieldPath:
+		s, ok := next.(string)
+		if !ok {
+			return nil, &FieldError{Message: messages[2]}
+		}
+
+		return s, nil
+	case FieldQueryParams:
+		switch v := next.(type) {
+		case string: // a raw query string, sent as is
+			return strings.TrimPrefix(v, "?"), nil
+		case []any:
+			return encodeQueryPairs(v)
+		case map[string]any:
+			return coerceMultimap(v, ErrorQueryParamsValue)
+		default:
+			return nil, &FieldError{Message: messages[2]}
+		}
+	case FieldRequestHeaders, FieldResponseHeaders:
+		m, ok := next.(map[string]any) // jq results are forced to be map[string]any
+		if !ok {
+			return nil, &FieldError{Message: messages[2]}
+		}
+
+		return coerceMultimap(m, ErrorHeadersValue)
+	case FieldStatusCode:
+		return coerceStatus(next)
+	case FieldRequestBody, FieldResponseBody:
+		b, err := encodeBody(conf.OutputFormat[field], next)
+		if err != nil {
+			return nil, &FieldError{Message: messages[2], Err: err}
+		}
+
+		return encodedBody{Value: next, Bytes: b}, nil
+	default:
+		return next, nil
+	}
+}
+
+// Multimap is the result of a query params or headers program once coerced: the values by key,
+// and the keys whose value is null, meaning they are removed.
+type Multimap struct {
+	Values  map[string][]string `json:"values"`
+	Removed []string            `json:"removed"`
+}
+
+// coerceValue converts a scalar jq value to the string it stands for in a query param or header.
+func coerceValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case *big.Int:
+		return v.String(), true
+	case json.Number:
+		return v.String(), true
+	default:
+		return "", false
+	}
+}
+
+// coerceMultimap converts the result of a query params or headers program: each value is a
+// string, a number or a boolean, a list of them, or null to remove the key. The error lists the
+// keys whose value can't be converted, under the given message.
+func coerceMultimap(m map[string]any, message string) (Multimap, error) {
+	multimap := Multimap{Values: make(map[string][]string, len(m)), Removed: []string{}}
+	errs := []string{} // by key, all the invalid keys are reported at once
+
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		switch v := m[k].(type) {
+		case nil:
+			multimap.Removed = append(multimap.Removed, k)
+		case []any:
+			values := make([]string, 0, len(v))
+
+			for i, value := range v {
+				s, ok := coerceValue(value)
+				if !ok {
+					errs = append(errs, fmt.Sprintf("%s[%d] is %s", k, i, gojq.TypeOf(value)))
+
+					break
+				}
+
+				values = append(values, s)
+			}
+
+			multimap.Values[k] = values
+		default:
+			s, ok := coerceValue(v)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s is %s", k, gojq.TypeOf(v)))
+
+				continue
+			}
+
+			multimap.Values[k] = []string{s}
+		}
+	}
+
+	if len(errs) > 0 {
+		return Multimap{}, &FieldError{Message: message, Err: errors.New(strings.Join(errs, ", "))}
+	}
+
+	return multimap, nil
+}
+
+// encodeQueryPairs encodes the [key, value] pairs returned by a query params program into a raw
+// query string, keeping their order and repetitions. A pair without a value, [key] or [key, null],
+// is a flag such as ?debug.
+func encodeQueryPairs(pairs []any) (string, error) {
+	params := make([]string, 0, len(pairs))
+	errs := []string{} // by index, all the invalid pairs are reported at once
+
+	for i, pair := range pairs {
+		p, ok := pair.([]any)
+		if !ok || len(p) < 1 || len(p) > 2 {
+			errs = append(errs, fmt.Sprintf("[%d] is not a [key, value] pair", i))
+
+			continue
+		}
+
+		k, ok := coerceValue(p[0])
+		if !ok {
+			errs = append(errs, fmt.Sprintf("[%d][0] is %s", i, gojq.TypeOf(p[0])))
+
+			continue
+		}
+
+		if len(p) == 1 || p[1] == nil {
+			params = append(params, url.QueryEscape(k))
+
+			continue
+		}
+
+		v, ok := coerceValue(p[1])
+		if !ok {
+			errs = append(errs, fmt.Sprintf("[%d][1] is %s", i, gojq.TypeOf(p[1])))
+
+			continue
+		}
+
+		params = append(params, url.QueryEscape(k)+"="+url.QueryEscape(v))
+	}
+
+	if len(errs) > 0 {
+		return "", &FieldError{Message: ErrorQueryParamsValue, Err: errors.New(strings.Join(errs, ", "))}
+	}
+
+	return strings.Join(params, "&"), nil
+}
+
+// Status is the result of a status code program once coerced, a zero Code meaning the program
+// returned null and the upstream status is kept. Kong can't set the reason phrase, it's only logged.
+type Status struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// coerceStatus converts the result of a status code program: a code, an object {code, reason}
+// or null.
+func coerceStatus(v any) (Status, error) {
+	switch v := v.(type) {
+	case nil:
+		return Status{}, nil
+	case map[string]any:
+		code, err := coerceStatusCode(v["code"])
+		if err != nil {
+			return Status{}, err
+		}
+
+		reason, ok := lo.ValueOr(v, "reason", any("")).(string)
+		if !ok && v["reason"] != nil {
+			return Status{}, &FieldError{Message: ErrorStatusCodeReason}
+		}
+
+		return Status{Code: code, Reason: reason}, nil
+	default:
+		code, err := coerceStatusCode(v)
+		if err != nil {
+			return Status{}, err
+		}
+
+		return Status{Code: code}, nil
+	}
+}
+
+// coerceStatusCode converts a status code given as an integer, an integral float such as 200.0
+// or a string of decimal digits such as "201", checking it's between 100 and 599.
+func coerceStatusCode(v any) (int, error) {
+	var code float64
+
+	switch v := v.(type) {
+	case int:
+		code = float64(v)
+	case float64:
+		code = v
+	case *big.Int:
+		return 0, &FieldError{Message: ErrorStatusCodeRange}
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return 0, &FieldError{Message: ErrorStatusCodeInteger}
+		}
+
+		code = f
+	case string:
+		// no sign, exponent nor hexadecimal float, "1e2" isn't a status code
+		if v == "" || strings.Trim(v, "0123456789") != "" {
+			return 0, &FieldError{Message: ErrorStatusCodeInteger}
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, &FieldError{Message: ErrorStatusCodeRange}
+		}
+
+		code = float64(n)
+	default:
+		return 0, &FieldError{Message: ErrorStatusCodeInteger}
+	}
+
+	if code != math.Trunc(code) {
+		return 0, &FieldError{Message: ErrorStatusCodeInteger}
+	}
+
+	if code < 100 || code > 599 {
+		return 0, &FieldError{Message: ErrorStatusCodeRange}
+	}
+
+	return int(code), nil
+}
+
+// failField logs the failure of a field program and replies with a 500 carrying its message.
+func failField(ctx context.Context, conf Config, kong *Kong, logger *logrus.Entry, err error) {
+	if fieldErr, ok := err.(*FieldError); ok {
+		if fieldErr.Err != nil {
+			logger = logger.WithError(fieldErr.Err)
+		}
+
+		logger.Error(fieldErr.Message)
+	} else {
+		logger.WithError(err).Error("field error")
+	}
+
+	exit(ctx, conf, kong, http.StatusInternalServerError, []byte(err.Error()), map[string][]string{})
+}
+
+// hasHeader tells whether a multimap of headers has the given header, whatever its case.
+func hasHeader(headers map[string][]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// headerValuesOf returns the values of a header of a multimap of headers, whatever the case of
+// its name.
+func headerValuesOf(headers map[string][]string, name string) []string {
+	values := []string{}
+
+	for _, k := range slices.Sorted(maps.Keys(headers)) {
+		if strings.EqualFold(k, name) {
+			values = append(values, headers[k]...)
+		}
+	}
+
+	return values
+}
+
+// multimapArgument converts a multimap of query params or headers for the jq context.
+func multimapArgument(m map[string][]string) map[string]any {
+	return lo.MapValues(m, func(values []string, _ string) any {
+		return lo.Map(values, func(s string, _ int) any { return s })
+	})
+}
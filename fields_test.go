@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+// TestCoerceStatusCode converts the status codes a program may return, and checks the error
+// messages of the ones that aren't integers between 100 and 599.
+func TestCoerceStatusCode(t *testing.T) {
+	for _, tt := range []struct {
+		value    any
+		expected int
+		message  string
+	}{
+		{value: 201, expected: 201},
+		{value: 200.0, expected: 200},
+		{value: json.Number("404"), expected: 404},
+		{value: json.Number("2e2"), expected: 200},
+		{value: "201", expected: 201},
+		{value: "099", message: ErrorStatusCodeRange},
+		{value: 200.5, message: ErrorStatusCodeInteger},
+		{value: 99, message: ErrorStatusCodeRange},
+		{value: 600.0, message: ErrorStatusCodeRange},
+		{value: new(big.Int).Lsh(big.NewInt(1), 70), message: ErrorStatusCodeRange},
+		{value: "99999999999999999999", message: ErrorStatusCodeRange},
+		{value: "0x1p7", message: ErrorStatusCodeInteger},
+		{value: "1e2", message: ErrorStatusCodeInteger},
+		{value: "200.0", message: ErrorStatusCodeInteger},
+		{value: "+201", message: ErrorStatusCodeInteger},
+		{value: " 201", message: ErrorStatusCodeInteger},
+		{value: "", message: ErrorStatusCodeInteger},
+		{value: true, message: ErrorStatusCodeInteger},
+	} {
+		code, err := coerceStatusCode(tt.value)
+
+		if tt.message == "" {
+			if err != nil || code != tt.expected {
+				t.Errorf("expected %#v to give %d, got %d, %v", tt.value, tt.expected, code, err)
+			}
+
+			continue
+		}
+
+		if fieldErr, ok := err.(*FieldError); !ok || fieldErr.Message != tt.message {
+			t.Errorf("expected %#v to fail with %q, got %d, %v", tt.value, tt.message, code, err)
+		}
+	}
+}
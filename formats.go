@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON = "json"
+	FormatRaw  = "raw"
+	FormatXML  = "xml"
+	FormatYAML = "yaml"
+	FormatForm = "form"
+	FormatCSV  = "csv"
+)
+
+// FormatContentTypes are the Content-Type of the bodies encoded in each output format.
+var FormatContentTypes = map[string]string{
+	FormatJSON: "application/json",
+	FormatRaw:  "text/plain; charset=utf-8",
+	FormatXML:  "application/xml",
+	FormatYAML: "application/yaml",
+	FormatForm: "application/x-www-form-urlencoded",
+	FormatCSV:  "text/csv",
+}
+
+// StaleBodyHeaders are the headers describing a body that no longer hold once it's replaced.
+var StaleBodyHeaders = []string{"Content-Length", "Content-Encoding", "ETag"}
+
+const formatMultipart = "multipart" // only ever decoded
+
+const (
+	xmlAttributePrefix = "@"
+	xmlTextKey         = "#text"
+)
+
+var (
+	ErrXMLRoot      = errors.New("xml output must be an object with a single root element")
+	ErrCSVRows      = errors.New("csv output must be an array of objects or an array of arrays")
+	ErrFormObject   = errors.New("form output must be an object")
+	ErrOutputFormat = errors.New("unknown output format")
+)
+
+// bodyFormat returns the format of a body given its Content-Type, empty when it isn't one we decode.
+func bodyFormat(contentType string) (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+
+	switch {
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return FormatJSON, params
+	case mediaType == "application/xml", mediaType == "text/xml", strings.HasSuffix(mediaType, "+xml"):
+		return FormatXML, params
+	case mediaType == "application/yaml", mediaType == "application/x-yaml", mediaType == "text/yaml":
+		return FormatYAML, params
+	case mediaType == "application/x-www-form-urlencoded":
+		return FormatForm, params
+	case mediaType == "multipart/form-data":
+		return formatMultipart, params
+	case mediaType == "text/csv":
+		return FormatCSV, params
+	default:
+		return "", nil
+	}
+}
+
+// decodeBody decodes a body into a jq value according to its Content-Type, it returns nil
+// when the content type is not one we know how to decode.
+func decodeBody(contentType string, body []byte) (any, error) {
+	format, params := bodyFormat(contentType)
+
+	switch format {
+	case FormatJSON:
+		var v any
+
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&v); err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	case FormatXML:
+		return decodeXML(body)
+	case FormatYAML:
+		var v any
+
+		if err := yaml.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+
+		return normalizeYAML(v), nil
+	case FormatForm:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+
+		return lo.MapValues(values, func(s []string, _ string) any {
+			return lo.Map(s, func(s string, _ int) any { return s })
+		}), nil
+	case formatMultipart:
+		return decodeMultipart(body, params["boundary"])
+	case FormatCSV:
+		return decodeCSV(body)
+	default:
+		return nil, nil
+	}
+}
+
+// decodeXML maps an XML document to a jq value:
+//   - an element becomes an object under its name, the root element included
+//   - attributes become "@name" keys
+//   - the text of an element with attributes or children becomes a "#text" key
+//   - an element with nothing but text becomes a string
+//   - repeated elements become arrays
+//
+// Namespaces prefixes are dropped, only local names are kept.
+func decodeXML(body []byte) (any, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			element, err := decodeXMLElement(decoder, start)
+			if err != nil {
+				return nil, err
+			}
+
+			return map[string]any{start.Name.Local: element}, nil
+		}
+	}
+}
+
+func decodeXMLElement(decoder *xml.Decoder, start xml.StartElement) (any, error) {
+	element := map[string]any{}
+
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+
+		element[xmlAttributePrefix+attr.Name.Local] = attr.Value
+	}
+
+	var text strings.Builder
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(decoder, token)
+			if err != nil {
+				return nil, err
+			}
+
+			name := token.Name.Local
+
+			switch existing := element[name].(type) {
+			case nil:
+				element[name] = child
+			case []any:
+				element[name] = append(existing, child)
+			default:
+				element[name] = []any{existing, child}
+			}
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			content := strings.TrimSpace(text.String())
+
+			if len(element) == 0 {
+				return content, nil
+			}
+
+			if content != "" {
+				element[xmlTextKey] = content
+			}
+
+			return element, nil
+		}
+	}
+}
+
+// normalizeYAML turns the values yaml.v3 decodes into values jq understands.
+func normalizeYAML(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		return lo.MapValues(v, func(v any, _ string) any { return normalizeYAML(v) })
+	case map[any]any:
+		return lo.MapEntries(v, func(k, v any) (string, any) { return fmt.Sprint(k), normalizeYAML(v) })
+	case []any:
+		return lo.Map(v, func(v any, _ int) any { return normalizeYAML(v) })
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
+
+// decodeMultipart maps multipart/form-data parts by name, as lists like query params: fields
+// are strings while files are {filename, content_type, content} objects.
+func decodeMultipart(body []byte, boundary string) (any, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	fields := map[string]any{}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return fields, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+
+		var value any = string(content)
+
+		if part.FileName() != "" {
+			value = map[string]any{
+				"filename":     part.FileName(),
+				"content_type": part.Header.Get("Content-Type"),
+				"content":      string(content),
+			}
+		}
+
+		values, _ := fields[part.FormName()].([]any)
+		fields[part.FormName()] = append(values, value)
+	}
+}
+
+// decodeCSV maps a CSV document to an array of objects keyed by the header row.
+func decodeCSV(body []byte) (any, error) {
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return []any{}, nil
+	}
+
+	header := records[0]
+
+	return lo.Map(records[1:], func(record []string, _ int) any {
+		row := map[string]any{}
+
+		for i, value := range record {
+			if i < len(header) {
+				row[header[i]] = value
+			}
+		}
+
+		return row
+	}), nil
+}
+
+// decodesBodies tells whether the bodies are decoded, validating them against schemas requires it.
+func (conf Config) decodesBodies() bool {
+	return conf.DecodeBodies || conf.RequestSchema != "" || conf.ResponseSchema != ""
+}
+
+// decodedBody decodes a body for the jq context, it logs malformed bodies rather than failing as
+// the body is still available as a string.
+func (conf Config) decodedBody(logger *logrus.Entry, getHeader func(string) (string, error), body any, truncated bool) any {
+	s, ok := body.(string)
+	if !conf.decodesBodies() || !ok || truncated {
+		return nil
+	}
+
+	contentType, _ := getHeader("content-type")
+
+	decoded, err := decodeBody(contentType, []byte(s))
+	if err != nil {
+		logger.WithError(err).WithField("content_type", contentType).Warn("failed to decode body")
+
+		return nil
+	}
+
+	return decoded
+}
+
+func contentTypeOf(format string) string {
+	return lo.ValueOr(FormatContentTypes, format, FormatContentTypes[FormatJSON])
+}
+
+// replacedBodyHeaders fixes the response headers once the body is replaced: stale headers are
+// dropped, the Content-Type of the output format is set unless jq set one, and so is the ETag
+// when asked to.
+func (conf Config) replacedBodyHeaders(format string, headers map[string][]string, body []byte) map[string][]string {
+	headers = lo.OmitBy(headers, func(k string, _ []string) bool {
+		return lo.ContainsBy(StaleBodyHeaders, func(stale string) bool { return strings.EqualFold(k, stale) })
+	})
+
+	if !lo.SomeBy(lo.Keys(headers), func(k string) bool { return strings.EqualFold(k, "Content-Type") }) {
+		headers["Content-Type"] = []string{contentTypeOf(format)}
+	}
+
+	if conf.ETag {
+		headers["ETag"] = []string{bodyETag(body)}
+	}
+
+	return headers
+}
+
+// bodyETag is the strong ETag of a body, as it's sent.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// encodeBody encodes the result of a body jq query in the given output format, json by default.
+func encodeBody(format string, v any) ([]byte, error) {
+	switch format {
+	case "", FormatJSON:
+		return json.Marshal(v)
+	case FormatRaw:
+		if s, ok := v.(string); ok {
+			return []byte(s), nil
+		}
+
+		return json.Marshal(v)
+	case FormatXML:
+		return encodeXML(v)
+	case FormatYAML:
+		return yaml.Marshal(v)
+	case FormatForm:
+		return encodeForm(v)
+	case FormatCSV:
+		return encodeCSV(v)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrOutputFormat, format)
+	}
+}
+
+// encodeXML is the reverse of decodeXML, object keys are sorted as jq objects don't keep their order.
+func encodeXML(v any) ([]byte, error) {
+	root, ok := v.(map[string]any)
+	if !ok || len(root) != 1 {
+		return nil, ErrXMLRoot
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+
+	for name, element := range root {
+		if err := encodeXMLElement(encoder, name, element); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeXMLElement(encoder *xml.Encoder, name string, v any) error {
+	if values, ok := v.([]any); ok {
+		for _, value := range values {
+			if err := encodeXMLElement(encoder, name, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+
+	element, ok := v.(map[string]any)
+	if !ok {
+		return encoder.EncodeElement(scalarString(v), start)
+	}
+
+	keys := lo.Keys(element)
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if attr, ok := strings.CutPrefix(k, xmlAttributePrefix); ok {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr}, Value: scalarString(element[k])})
+		}
+	}
+
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	if text, ok := element[xmlTextKey]; ok {
+		if err := encoder.EncodeToken(xml.CharData(scalarString(text))); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range keys {
+		if k == xmlTextKey || strings.HasPrefix(k, xmlAttributePrefix) {
+			continue
+		}
+
+		if err := encodeXMLElement(encoder, k, element[k]); err != nil {
+			return err
+		}
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+func encodeForm(v any) ([]byte, error) {
+	object, ok := v.(map[string]any)
+	if !ok {
+		return nil, ErrFormObject
+	}
+
+	values := url.Values{}
+
+	for k, v := range object {
+		if list, ok := v.([]any); ok {
+			for _, item := range list {
+				values.Add(k, scalarString(item))
+			}
+		} else {
+			values.Add(k, scalarString(v))
+		}
+	}
+
+	return []byte(values.Encode()), nil
+}
+
+// encodeCSV writes an array of objects with a header row made of their sorted keys, or an
+// array of arrays as is.
+func encodeCSV(v any) ([]byte, error) {
+	rows, ok := v.([]any)
+	if !ok {
+		return nil, ErrCSVRows
+	}
+
+	var records [][]string
+
+	if objects, ok := lo.FromAnySlice[map[string]any](rows); ok {
+		header := lo.Uniq(lo.FlatMap(objects, func(o map[string]any, _ int) []string { return lo.Keys(o) }))
+		sort.Strings(header)
+
+		records = append(records, header)
+
+		for _, object := range objects {
+			records = append(records, lo.Map(header, func(k string, _ int) string { return scalarString(object[k]) }))
+		}
+	} else if arrays, ok := lo.FromAnySlice[[]any](rows); ok {
+		for _, array := range arrays {
+			records = append(records, lo.Map(array, func(v any, _ int) string { return scalarString(v) }))
+		}
+	} else {
+		return nil, ErrCSVRows
+	}
+
+	var buf bytes.Buffer
+
+	writer := csv.NewWriter(&buf)
+	if err := writer.WriteAll(records); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// scalarString renders a jq value as text: strings as is, null as nothing and anything else as JSON.
+func scalarString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return string(lo.Must(json.Marshal(v)))
+	}
+}
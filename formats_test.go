@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestDecodeBody decodes a body of each format we know and checks the jq value it maps to, and
+// that malformed bodies are errors.
+func TestDecodeBody(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		expected    any
+		err         bool
+	}{
+		{
+			name:        "json",
+			contentType: "application/problem+json",
+			body:        `{"id": 7, "tags": ["a"]}`,
+			expected:    map[string]any{"id": json.Number("7"), "tags": []any{"a"}},
+		},
+		{
+			name:        "malformed json",
+			contentType: "application/json",
+			body:        `{"id": `,
+			err:         true,
+		},
+		{
+			name:        "xml",
+			contentType: "application/xml; charset=utf-8",
+			body:        `<?xml version="1.0"?><user id="7"><name>Ada</name><tag>a</tag><tag>b</tag><note lang="en">hi</note></user>`,
+			expected: map[string]any{"user": map[string]any{
+				"@id":  "7",
+				"name": "Ada",
+				"tag":  []any{"a", "b"},
+				"note": map[string]any{"@lang": "en", "#text": "hi"},
+			}},
+		},
+		{
+			name:        "xml namespaces",
+			contentType: "text/xml",
+			body:        `<a:user xmlns:a="urn:a" xmlns="urn:b"><a:name>Ada</a:name></a:user>`,
+			expected:    map[string]any{"user": map[string]any{"name": "Ada"}},
+		},
+		{
+			name:        "malformed xml",
+			contentType: "application/xml",
+			body:        `<user><name>Ada</user>`,
+			err:         true,
+		},
+		{
+			name:        "unterminated xml",
+			contentType: "application/xml",
+			body:        `<user><name>Ada</name>`,
+			err:         true,
+		},
+		{
+			name:        "yaml",
+			contentType: "application/yaml",
+			body:        "id: 7\ncreated: 2024-01-02T03:04:05Z\nlabels:\n  1: one\n",
+			expected: map[string]any{
+				"id":      7,
+				"created": "2024-01-02T03:04:05Z",
+				"labels":  map[string]any{"1": "one"},
+			},
+		},
+		{
+			name:        "malformed yaml",
+			contentType: "text/yaml",
+			body:        "id: [7",
+			err:         true,
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=Ada&tag=a&tag=b",
+			expected:    map[string]any{"name": []any{"Ada"}, "tag": []any{"a", "b"}},
+		},
+		{
+			name:        "malformed form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "name=%zz",
+			err:         true,
+		},
+		{
+			name:        "multipart",
+			contentType: "multipart/form-data; boundary=XyZ",
+			body: "--XyZ\r\n" +
+				"Content-Disposition: form-data; name=\"name\"\r\n\r\n" +
+				"Ada\r\n" +
+				"--XyZ\r\n" +
+				"Content-Disposition: form-data; name=\"avatar\"; filename=\"ada.png\"\r\n" +
+				"Content-Type: image/png\r\n\r\n" +
+				"PNG\r\n" +
+				"--XyZ--\r\n",
+			expected: map[string]any{
+				"name":   []any{"Ada"},
+				"avatar": []any{map[string]any{"filename": "ada.png", "content_type": "image/png", "content": "PNG"}},
+			},
+		},
+		{
+			name:        "multipart without a boundary",
+			contentType: "multipart/form-data",
+			body:        "--XyZ\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nAda\r\n--XyZ--\r\n",
+			err:         true,
+		},
+		{
+			name:        "truncated multipart",
+			contentType: "multipart/form-data; boundary=XyZ",
+			body:        "--XyZ\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nAda",
+			err:         true,
+		},
+		{
+			name:        "csv",
+			contentType: "text/csv",
+			body:        "id,name\n7,Ada\n8,Grace\n",
+			expected:    []any{map[string]any{"id": "7", "name": "Ada"}, map[string]any{"id": "8", "name": "Grace"}},
+		},
+		{
+			name:        "empty csv",
+			contentType: "text/csv",
+			body:        "",
+			expected:    []any{},
+		},
+		{
+			name:        "ragged csv",
+			contentType: "text/csv",
+			body:        "id,name\n7,Ada,extra\n",
+			err:         true,
+		},
+		{
+			name:        "unknown content type",
+			contentType: "application/octet-stream",
+			body:        "\x00\x01",
+		},
+		{
+			name:        "malformed content type",
+			contentType: "application/json; =",
+			body:        `{}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeBody(tt.contentType, []byte(tt.body))
+
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", decoded)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(decoded, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, decoded)
+			}
+		})
+	}
+}
+
+// TestEncodeBody encodes jq values in each output format and checks the bytes, and that values
+// a format can't hold are errors.
+func TestEncodeBody(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		format   string
+		value    any
+		expected string
+		err      error
+	}{
+		{name: "json by default", format: "", value: map[string]any{"id": 7}, expected: `{"id":7}`},
+		{name: "raw string", format: FormatRaw, value: "hello", expected: "hello"},
+		{name: "raw non string", format: FormatRaw, value: []any{1}, expected: "[1]"},
+		{
+			name:   "xml",
+			format: FormatXML,
+			value: map[string]any{"user": map[string]any{
+				"@id":  7,
+				"name": "Ada",
+				"tag":  []any{"a", "b"},
+				"note": map[string]any{"@lang": "en", "#text": "hi"},
+			}},
+			expected: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+				`<user id="7"><name>Ada</name><note lang="en">hi</note><tag>a</tag><tag>b</tag></user>`,
+		},
+		{name: "xml without a single root", format: FormatXML, value: map[string]any{"a": 1, "b": 2}, err: ErrXMLRoot},
+		{name: "xml of an array", format: FormatXML, value: []any{1}, err: ErrXMLRoot},
+		{name: "yaml", format: FormatYAML, value: map[string]any{"id": 7, "tags": []any{"a"}}, expected: "id: 7\ntags:\n    - a\n"},
+		{name: "form", format: FormatForm, value: map[string]any{"name": "Ada", "tag": []any{"a", "b"}, "n": 1}, expected: "n=1&name=Ada&tag=a&tag=b"},
+		{name: "form of an array", format: FormatForm, value: []any{"a"}, err: ErrFormObject},
+		{
+			name:     "csv of objects",
+			format:   FormatCSV,
+			value:    []any{map[string]any{"id": 7, "name": "Ada"}, map[string]any{"id": 8, "email": "g@example.com"}},
+			expected: "email,id,name\n,7,Ada\ng@example.com,8,\n",
+		},
+		{name: "csv of arrays", format: FormatCSV, value: []any{[]any{"id", "name"}, []any{7, "Ada, L."}}, expected: "id,name\n7,\"Ada, L.\"\n"},
+		{name: "csv of mixed rows", format: FormatCSV, value: []any{map[string]any{"id": 7}, []any{8}}, err: ErrCSVRows},
+		{name: "csv of an object", format: FormatCSV, value: map[string]any{"id": 7}, err: ErrCSVRows},
+		{name: "unknown format", format: "toml", value: map[string]any{}, err: ErrOutputFormat},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encodeBody(tt.format, tt.value)
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(encoded) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, encoded)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected.http golden files")
+
+// httpSeparator separates the upstream request from the client response in expected.http.
+var httpSeparator = "###"
+
+// parseHTTPMessage splits an HTTP message into its start line, headers and body. The body is
+// everything after the blank line, whatever the Content-Length, so that the files can be edited by hand.
+func parseHTTPMessage(message string) (string, map[string][]string, string, error) {
+	message = strings.ReplaceAll(message, "\r\n", "\n")
+
+	head, body, _ := strings.Cut(message, "\n\n")
+	scanner := bufio.NewScanner(strings.NewReader(head))
+
+	if !scanner.Scan() {
+		return "", nil, "", errors.New("empty HTTP message")
+	}
+
+	startLine := scanner.Text()
+	headers := map[string][]string{}
+
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			return "", nil, "", fmt.Errorf("malformed header line %q", scanner.Text())
+		}
+
+		name = strings.ToLower(strings.TrimSpace(name))
+		headers[name] = append(headers[name], strings.TrimSpace(value))
+	}
+
+	return startLine, headers, body, nil
+}
+
+func parseHTTPRequest(message string) (HTTPRequest, error) {
+	startLine, headers, body, err := parseHTTPMessage(message)
+	if err != nil {
+		return HTTPRequest{}, err
+	}
+
+	fields := strings.Fields(startLine)
+	if len(fields) < 2 {
+		return HTTPRequest{}, fmt.Errorf("malformed request line %q", startLine)
+	}
+
+	target, err := url.ParseRequestURI(fields[1])
+	if err != nil {
+		return HTTPRequest{}, err
+	}
+
+	return HTTPRequest{
+		Method:   fields[0],
+		Path:     target.Path,
+		Query:    target.Query(),
+		RawQuery: target.RawQuery,
+		Headers:  headers,
+		Body:     body,
+	}, nil
+}
+
+func parseHTTPResponse(message string) (HTTPResponse, error) {
+	startLine, headers, body, err := parseHTTPMessage(message)
+	if err != nil {
+		return HTTPResponse{}, err
+	}
+
+	fields := strings.Fields(startLine)
+	if len(fields) < 2 {
+		return HTTPResponse{}, fmt.Errorf("malformed status line %q", startLine)
+	}
+
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return HTTPResponse{}, fmt.Errorf("malformed status line %q", startLine)
+	}
+
+	return HTTPResponse{Status: status, Headers: headers, Body: body}, nil
+}
+
+// formatHTTPMessage writes an HTTP message with its headers sorted, so that goldens are stable.
+func formatHTTPMessage(w io.Writer, startLine string, headers map[string][]string, body string) {
+	fmt.Fprintln(w, startLine)
+
+	keys := lo.Keys(headers)
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		for _, value := range headers[k] {
+			fmt.Fprintf(w, "%s: %s\n", k, value)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%s", body)
+}
+
+func formatExpected(upstreamRequest *HTTPRequest, clientResponse HTTPResponse) string {
+	var b strings.Builder
+
+	if upstreamRequest != nil {
+		target := upstreamRequest.Path
+		if rawQuery := upstreamRequest.rawQuery(); rawQuery != "" {
+			target += "?" + rawQuery
+		}
+
+		formatHTTPMessage(&b, upstreamRequest.Method+" "+target+" HTTP/1.1", upstreamRequest.Headers, upstreamRequest.Body)
+		fmt.Fprintf(&b, "\n%s\n", httpSeparator)
+	}
+
+	formatHTTPMessage(&b, fmt.Sprintf("HTTP/1.1 %d", clientResponse.Status), clientResponse.Headers, clientResponse.Body)
+
+	return b.String()
+}
+
+// TestGolden plays each testdata/<case> through the plugin: config.yaml is the plugin
+// configuration, request.http the client request and upstream.http the upstream response.
+// expected.http holds the request the upstream gets, a ### line, then the response the client
+// gets, or only the response when the access phase ends the request. Run with -update to rewrite it.
+// expected-replay.http, when there is one, holds the outcome of the request played a second time.
+func TestGolden(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	cases, err := filepath.Glob(filepath.Join("testdata", "*", "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, configPath := range cases {
+		dir := filepath.Dir(configPath)
+
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			conf, err := LoadConfig(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// each case starts with an empty response cache
+			conf.instance = dir
+
+			responseCachesMu.Lock()
+			delete(responseCaches, dir)
+			responseCachesMu.Unlock()
+
+			requestFile, err := os.ReadFile(filepath.Join(dir, "request.http"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			request, err := parseHTTPRequest(string(requestFile))
+			if err != nil {
+				t.Fatalf("request.http: %v", err)
+			}
+
+			// a case with an expected-replay.http is played a second time, to cover the response cache
+			for _, expectedName := range []string{"expected.http", "expected-replay.http"} {
+				expectedPath := filepath.Join(dir, expectedName)
+
+				if _, err := os.Stat(expectedPath); expectedName != "expected.http" && err != nil {
+					break
+				}
+
+				upstreamRequest, clientResponse, err := conf.Play(request, func(HTTPRequest) (HTTPResponse, error) {
+					upstreamFile, err := os.ReadFile(filepath.Join(dir, "upstream.http"))
+					if err != nil {
+						return HTTPResponse{}, err
+					}
+
+					return parseHTTPResponse(string(upstreamFile))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := formatExpected(upstreamRequest, clientResponse)
+
+				if *update {
+					if err := os.WriteFile(expectedPath, []byte(got), 0o644); err != nil { //nolint:gosec // golden files are meant to be read
+						t.Fatal(err)
+					}
+
+					continue
+				}
+
+				expected, err := os.ReadFile(expectedPath)
+				if err != nil {
+					t.Fatalf("%v, run go test -update to create it", err)
+				}
+
+				if got != strings.ReplaceAll(string(expected), "\r\n", "\n") {
+					t.Errorf("unexpected %s outcome, run go test -update to accept it\n--- expected\n%s\n--- got\n%s", expectedName, expected, got)
+				}
+			}
+		})
+	}
+}
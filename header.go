@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/itchyny/gojq"
+	"github.com/samber/lo"
+)
+
+const (
+	HeaderCasePreserve  = "preserve"  // header names as kong gives them in the context, lower-cased, and as jq returns them
+	HeaderCaseLower     = "lower"     // content-type
+	HeaderCaseCanonical = "canonical" // Content-Type
+)
+
+var ErrHeaderName = errors.New("header name is not a string")
+
+// headerName normalizes a header name according to header_case.
+func (conf Config) headerName(name string) string {
+	switch conf.HeaderCase {
+	case HeaderCaseLower:
+		return strings.ToLower(name)
+	case HeaderCaseCanonical:
+		return http.CanonicalHeaderKey(name)
+	default:
+		return name
+	}
+}
+
+// normalizeHeaders normalizes the names of headers according to header_case, merging the values
+// of the names it folds.
+func (conf Config) normalizeHeaders(headers map[string][]string) map[string][]string {
+	if headers == nil || conf.HeaderCase == "" || conf.HeaderCase == HeaderCasePreserve {
+		return headers
+	}
+
+	normalized := make(map[string][]string, len(headers))
+
+	for k, values := range headers {
+		normalized[conf.headerName(k)] = append(normalized[conf.headerName(k)], values...)
+	}
+
+	return normalized
+}
+
+// headerValues returns the values of a header, whatever the case of its name, from a headers
+// object, an object with a headers key such as .request, or the root of the context, whose
+// request headers are the ones read then.
+func headerValues(v any, name string) []any {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return []any{}
+	}
+
+	if request, ok := m["request"].(map[string]any); ok && m["headers"] == nil {
+		m, _ = request["headers"].(map[string]any) // absent from version 1 response contexts
+	} else if headers, ok := m["headers"].(map[string]any); ok {
+		m = headers
+	}
+
+	values := []any{}
+	keys := lo.Keys(m)
+	slices.Sort(keys) // deterministic when the same name is given in several cases
+
+	for _, k := range keys {
+		if !strings.EqualFold(k, name) {
+			continue
+		}
+
+		switch value := m[k].(type) {
+		case []any:
+			values = append(values, value...)
+		case nil:
+		default:
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// headerFunctions are the jq functions to read headers regardless of the case of their names:
+// header(name) returns the first value of a header or null, headers(name) all its values.
+var headerFunctions = []gojq.CompilerOption{
+	gojq.WithFunction("header", 1, 1, func(v any, args []any) any {
+		name, ok := args[0].(string)
+		if !ok {
+			return ErrHeaderName
+		}
+
+		if values := headerValues(v, name); len(values) > 0 {
+			return values[0]
+		}
+
+		return nil
+	}),
+	gojq.WithFunction("headers", 1, 1, func(v any, args []any) any {
+		name, ok := args[0].(string)
+		if !ok {
+			return ErrHeaderName
+		}
+
+		return headerValues(v, name)
+	}),
+}
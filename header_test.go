@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestHeaderValues reads a header from the inputs header() and headers() accept.
+func TestHeaderValues(t *testing.T) {
+	headers := map[string]any{"Content-Type": []any{"application/json"}, "accept": []any{"text/html", "*/*"}}
+
+	for _, tt := range []struct {
+		name     string
+		input    any
+		header   string
+		expected []any
+	}{
+		{name: "headers object", input: headers, header: "content-type", expected: []any{"application/json"}},
+		{name: "request", input: map[string]any{"method": "GET", "headers": headers}, header: "Accept", expected: []any{"text/html", "*/*"}},
+		{
+			name:     "context root",
+			input:    map[string]any{"request": map[string]any{"headers": headers}, "response": map[string]any{"status_code": 200}},
+			header:   "content-type",
+			expected: []any{"application/json"},
+		},
+		{
+			name:     "context root without request headers",
+			input:    map[string]any{"request": map[string]any{"path": "/users"}},
+			header:   "path",
+			expected: []any{},
+		},
+		{name: "scalar value", input: map[string]any{"x-id": "7"}, header: "X-Id", expected: []any{"7"}},
+		{name: "missing", input: headers, header: "etag", expected: []any{}},
+		{name: "not an object", input: "application/json", header: "content-type", expected: []any{}},
+	} {
+		if got := headerValues(tt.input, tt.header); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
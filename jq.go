@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/samber/lo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	PhaseAccess   = "access"
+	PhaseResponse = "response"
+)
+
+const (
+	FieldWhen               = "when"
+	FieldMethod             = "method"
+	FieldPath               = "path"
+	FieldQueryParams        = "query_params"
+	FieldRequestHeaders     = "request_headers"
+	FieldRequestBody        = "request_body"
+	FieldResponseHeaders    = "response_headers"
+	FieldStatusCode         = "status_code"
+	FieldResponseBody       = "response_body"
+	FieldCacheKey           = "cache_key"
+	FieldRequestSchemaError = "request_schema_error"
+	FieldCacheTTL           = "cache_ttl"
+	FieldRedirect           = "redirect"
+	FieldCORS               = "cors"
+	FieldSign               = "sign"
+)
+
+// PhaseFields lists the fields of each phase, in the order they are processed.
+var PhaseFields = map[string][]string{
+	PhaseAccess:   {FieldMethod, FieldPath, FieldQueryParams, FieldRequestHeaders, FieldRequestBody},
+	PhaseResponse: {FieldResponseHeaders, FieldStatusCode, FieldResponseBody},
+}
+
+const (
+	OutcomeOK       = "ok"
+	OutcomeNoResult = "no_result"
+	OutcomeError    = "error"
+	OutcomeTimeout  = "timeout"
+)
+
+// compiledQueries caches the compiled jq programs by query, it is shared by all plugin instances
+var (
+	compiledQueries    sync.Map
+	compileCacheHits   atomic.Uint64
+	compileCacheMisses atomic.Uint64
+)
+
+func compileQuery(query string) (*gojq.Code, error) {
+	if code, ok := compiledQueries.Load(query); ok {
+		compileCacheHits.Add(1)
+
+		return code.(*gojq.Code), nil
+	}
+
+	compileCacheMisses.Add(1)
+
+	parsed, err := gojq.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := gojq.Compile(parsed, headerFunctions...)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledQueries.Store(query, code)
+
+	return code, nil
+}
+
+func compileCacheHitRatio() float64 {
+	hits := float64(compileCacheHits.Load())
+	total := hits + float64(compileCacheMisses.Load())
+
+	if total == 0 {
+		return 0
+	}
+
+	return hits / total
+}
+
+// runQuery runs a jq query against the input and returns its first result, the same way
+// iter.Next() does, while recording how the run went. The run is cancelled once it exceeds
+// program_timeout_ms, the result is then a context.DeadlineExceeded error.
+func runQuery(ctx context.Context, conf Config, phase, field, query string, input any) (any, bool) {
+	code := lo.Must(compileQuery(query))
+
+	ctx, span := tracer.Start(ctx, "jq "+field, trace.WithAttributes(
+		attribute.String("kong_jq.phase", phase),
+		attribute.String("kong_jq.field", field),
+	))
+	defer span.End()
+
+	if conf.ProgramTimeoutMs > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(conf.ProgramTimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	trace := debugFromContext(ctx)
+	if trace != nil {
+		trace.recordInput(phase, input, conf.debugRedactedHeaders())
+	}
+
+	start := time.Now()
+	next, ok := code.RunWithContext(ctx, input).Next()
+	elapsed := time.Since(start)
+
+	if trace != nil {
+		trace.recordProgram(phase, field, next, ok, elapsed, conf.debugRedactedHeaders())
+	}
+
+	outcome := OutcomeOK
+
+	if !ok {
+		outcome = OutcomeNoResult
+	} else if err, isErr := next.(error); isErr {
+		outcome = OutcomeError
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			outcome = OutcomeTimeout
+		}
+
+		span.RecordError(err)
+	}
+
+	if span.IsRecording() { // the result size is only worth computing when traces are exported
+		if outcome == OutcomeOK {
+			span.SetAttributes(
+				attribute.String("kong_jq.output_type", gojq.TypeOf(next)),
+				attribute.Int("kong_jq.result_size", resultSize(next)),
+			)
+		} else {
+			span.SetAttributes(attribute.String("kong_jq.error_code", outcome))
+			span.SetStatus(codes.Error, outcome)
+		}
+	}
+
+	MetricProgramRuns.WithLabelValues(phase, field, outcome, conf.instance).Inc()
+	MetricProgramDuration.WithLabelValues(phase, field, outcome, conf.instance).Observe(elapsed.Seconds())
+
+	return next, ok
+}
+
+// resultSize is the length of the result once encoded in JSON, or of the string itself.
+func resultSize(v any) int {
+	if s, ok := v.(string); ok {
+		return len(s)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+
+	return len(b)
+}
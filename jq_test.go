@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// scrapeMetrics returns the metrics as /metrics serves them.
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected /metrics status %d", recorder.Code)
+	}
+
+	return recorder.Body.String()
+}
+
+// TestMetrics plays a request through the plugin and checks the program runs it records, by
+// outcome, including the timeout of a program running over program_timeout_ms.
+func TestMetrics(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	conf := Config{
+		Path:             `"/new" + .request.path`,
+		Method:           `reduce range(1e9) as $i (0; . + 1) | tostring`,
+		QueryParams:      `empty`,
+		ProgramTimeoutMs: 10,
+		instance:         "metrics-test",
+	}
+
+	_, response, err := conf.Play(HTTPRequest{Method: http.MethodGet, Path: "/users"}, func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{Status: http.StatusOK}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != http.StatusInternalServerError {
+		t.Errorf("expected the method timeout to end the request with a 500, got %d", response.Status)
+	}
+
+	conf.Method = ""
+
+	if _, _, err := conf.Play(HTTPRequest{Method: http.MethodGet, Path: "/users"}, func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{Status: http.StatusOK}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := scrapeMetrics(t)
+
+	for _, expected := range []string{
+		`kong_jq_program_runs_total{field="method",instance="metrics-test",outcome="timeout",phase="access"} 1`,
+		`kong_jq_program_runs_total{field="path",instance="metrics-test",outcome="ok",phase="access"} 1`,
+		`kong_jq_program_runs_total{field="query_params",instance="metrics-test",outcome="no_result",phase="access"} 1`,
+		`kong_jq_program_duration_seconds_count{field="path",instance="metrics-test",outcome="ok",phase="access"} 1`,
+		`kong_jq_compile_cache_hits_total `,
+		`kong_jq_compile_cache_hit_ratio `,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("missing %q in the metrics", expected)
+		}
+	}
+}
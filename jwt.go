@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	JWTPolicyReject = "reject" // requests without a valid token are rejected with a 401
+	JWTPolicyIgnore = "ignore" // requests without a valid token go on, without claims
+)
+
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmRS256 = "RS256"
+)
+
+var jwtSharedKey = "kong_jq_jwt" // kong.ctx.shared key passing the token claims over to the response phase
+
+var (
+	ErrJWTMissing     = errors.New("missing bearer token")
+	ErrJWTMalformed   = errors.New("malformed token")
+	ErrJWTAlgorithm   = errors.New("unsupported token algorithm")
+	ErrJWTSignature   = errors.New("invalid token signature")
+	ErrJWTExpired     = errors.New("expired token")
+	ErrJWTNotYetValid = errors.New("token not valid yet")
+	ErrJWTKeys        = errors.New("invalid jwt keys") // a configuration error rather than a token one
+)
+
+// JWTConfig configures the verification of the bearer token of the requests, whose claims are
+// then given to the programs. The verification is enabled by any key.
+type JWTConfig struct {
+	Secrets    []string `json:"secrets"`     // the HS256 secrets
+	PublicKeys []string `json:"public_keys"` // the RS256 public keys, PEM encoded
+	JWKSFile   string   `json:"jwks_file"`   // the path of a local JWKS file holding more keys, RSA or oct ones
+	Policy     string   `json:"policy"`      // what to do with requests without a valid token: reject (default) or ignore
+	Leeway     int      `json:"leeway"`      // the clock skew in seconds tolerated when checking exp and nbf
+}
+
+type JWTContext struct {
+	Claims any    `json:"claims" description:"The claims of the verified bearer token, null without one."`
+	Error  string `json:"error,omitempty" description:"Why the token isn't verified, when the jwt policy is ignore."`
+}
+
+func (j JWTConfig) enabled() bool {
+	return len(j.Secrets) > 0 || len(j.PublicKeys) > 0 || j.JWKSFile != ""
+}
+
+// jwtKey is a verification key, the id of a JWKS key restricting it to the tokens with that kid.
+type jwtKey struct {
+	ID     string
+	Secret []byte
+	Public *rsa.PublicKey
+}
+
+// verifyJWT verifies the bearer token of the request, returning its claims.
+// The keys failing to parse is an ErrJWTKeys error, whatever the token.
+func (j JWTConfig) verifyJWT(kong *Kong, now time.Time) (map[string]any, error) {
+	keys, err := j.keys(now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrJWTKeys, err)
+	}
+
+	authorization, _ := kong.Request.GetHeader("authorization")
+
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return nil, ErrJWTMissing
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	claims := map[string]any{}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	if header.Alg != JWTAlgorithmHS256 && header.Alg != JWTAlgorithmRS256 {
+		return nil, ErrJWTAlgorithm
+	}
+
+	verified := lo.SomeBy(keys, func(key jwtKey) bool {
+		if key.ID != "" && header.Kid != "" && key.ID != header.Kid {
+			return false
+		}
+
+		switch {
+		case header.Alg == JWTAlgorithmHS256 && key.Secret != nil:
+			mac := hmac.New(sha256.New, key.Secret)
+			mac.Write(signed)
+
+			return hmac.Equal(mac.Sum(nil), signature)
+		case header.Alg == JWTAlgorithmRS256 && key.Public != nil:
+			return rsa.VerifyPKCS1v15(key.Public, crypto.SHA256, digest[:], signature) == nil
+		default:
+			return false
+		}
+	})
+
+	if !verified {
+		return nil, ErrJWTSignature
+	}
+
+	leeway := time.Duration(j.Leeway) * time.Second
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, ErrJWTExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-leeway)) {
+		return nil, ErrJWTNotYetValid
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return ErrJWTMalformed
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrJWTMalformed
+	}
+
+	return nil
+}
+
+// JWKSCheckInterval is how often the JWKS file is checked for changes, its keys being read again
+// when its modification time or its size change.
+var JWKSCheckInterval = 10 * time.Second
+
+type jwtKeySet struct {
+	keys      []jwtKey
+	modTime   time.Time // the modification time of the JWKS file the keys were read from
+	size      int64
+	checkedAt time.Time
+}
+
+// jwtKeySets holds the keys of each jwt configuration, they are parsed once per configuration
+// rather than on every request, and again when the JWKS file changes. Failures aren't kept, the
+// keys are parsed over again on the next request.
+var jwtKeySets sync.Map
+
+// keys returns the configured keys followed by the ones of the JWKS file.
+func (j JWTConfig) keys(now time.Time) ([]jwtKey, error) {
+	id := string(lo.Must(json.Marshal(j)))
+
+	if cached, ok := jwtKeySets.Load(id); ok {
+		set := cached.(jwtKeySet)
+
+		if j.JWKSFile == "" || now.Sub(set.checkedAt) < JWKSCheckInterval {
+			return set.keys, nil
+		}
+
+		if info, err := os.Stat(j.JWKSFile); err == nil && info.ModTime().Equal(set.modTime) && info.Size() == set.size {
+			set.checkedAt = now
+			jwtKeySets.Store(id, set)
+
+			return set.keys, nil
+		}
+	}
+
+	set, err := j.parseKeys(now)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtKeySets.Store(id, set)
+
+	return set.keys, nil
+}
+
+func (j JWTConfig) parseKeys(now time.Time) (jwtKeySet, error) {
+	set := jwtKeySet{
+		keys:      lo.Map(j.Secrets, func(secret string, _ int) jwtKey { return jwtKey{Secret: []byte(secret)} }),
+		checkedAt: now,
+	}
+
+	for _, publicKey := range j.PublicKeys {
+		key, err := parsePublicKey(publicKey)
+		if err != nil {
+			return set, err
+		}
+
+		set.keys = append(set.keys, jwtKey{Public: key})
+	}
+
+	if j.JWKSFile != "" {
+		// checked before it's read, a change while it's read is then caught by the next check
+		info, err := os.Stat(j.JWKSFile)
+		if err != nil {
+			return set, fmt.Errorf("jwks file: %w", err)
+		}
+
+		data, err := os.ReadFile(j.JWKSFile)
+		if err != nil {
+			return set, fmt.Errorf("jwks file: %w", err)
+		}
+
+		jwks, err := parseJWKS(data)
+		if err != nil {
+			return set, fmt.Errorf("jwks file: %w", err)
+		}
+
+		set.keys = append(set.keys, jwks...)
+		set.modTime, set.size = info.ModTime(), info.Size()
+	}
+
+	return set, nil
+}
+
+// parsePublicKey parses an RSA public key, in a PKIX, PKCS #1 or certificate PEM block.
+func parsePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+
+	var (
+		key any
+		err error
+	)
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var certificate *x509.Certificate
+
+		if certificate, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = certificate.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+// parseJWKS parses the RSA and oct keys of a JWKS document, skipping the other ones.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := []jwtKey{}
+
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+
+			exponent := new(big.Int).SetBytes(e).Int64()
+			keys = append(keys, jwtKey{ID: k.Kid, Public: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent)}})
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("invalid oct key %q", k.Kid)
+			}
+
+			keys = append(keys, jwtKey{ID: k.Kid, Secret: secret})
+		}
+	}
+
+	return keys, nil
+}
+
+func saveJWTContext(kong *Kong, jwt *JWTContext) error {
+	return kong.Ctx.SetShared(jwtSharedKey, string(lo.Must(json.Marshal(jwt))))
+}
+
+func loadJWTContext(kong *Kong) *JWTContext {
+	jwt := &JWTContext{}
+
+	s, err := kong.Ctx.GetSharedString(jwtSharedKey)
+	if err != nil || s == "" {
+		return jwt
+	}
+
+	_ = json.Unmarshal([]byte(s), jwt)
+
+	return jwt
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signHS256 signs a token with the given secret and kid.
+func signHS256(t *testing.T, secret, kid string) string {
+	t.Helper()
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"` + kid + `"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"ada"}`))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + claims))
+
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// writeJWKS writes a JWKS file holding a single oct key, dated at modTime.
+func writeJWKS(t *testing.T, path, kid, secret string, modTime time.Time) {
+	t.Helper()
+
+	jwks := `{"keys": [{"kty": "oct", "kid": "` + kid + `", "k": "` + base64.RawURLEncoding.EncodeToString([]byte(secret)) + `"}]}`
+
+	if err := os.WriteFile(path, []byte(jwks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestJWKSReload checks that a missing JWKS file isn't an error for good, and that the keys of a
+// rotated JWKS file are picked up once it's checked again.
+func TestJWKSReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	j := JWTConfig{JWKSFile: path}
+	now := time.Now()
+
+	verify := func(token string, now time.Time) error {
+		kong := &Kong{Request: &fakeRequest{request: HTTPRequest{
+			Headers: map[string][]string{"authorization": {"Bearer " + token}},
+		}}}
+
+		_, err := j.verifyJWT(kong, now)
+
+		return err
+	}
+
+	if err := verify(signHS256(t, "first", "k1"), now); !errors.Is(err, ErrJWTKeys) {
+		t.Fatalf("expected a keys error without the JWKS file, got %v", err)
+	}
+
+	writeJWKS(t, path, "k1", "first", now.Add(-time.Minute))
+
+	if err := verify(signHS256(t, "first", "k1"), now); err != nil {
+		t.Fatalf("expected the token to verify once the JWKS file is there, got %v", err)
+	}
+
+	writeJWKS(t, path, "k2", "second", now)
+
+	if err := verify(signHS256(t, "second", "k2"), now.Add(JWKSCheckInterval/2)); !errors.Is(err, ErrJWTSignature) {
+		t.Fatalf("expected the JWKS file not to be checked again before the interval, got %v", err)
+	}
+
+	later := now.Add(JWKSCheckInterval)
+
+	if err := verify(signHS256(t, "second", "k2"), later); err != nil {
+		t.Fatalf("expected the rotated key to verify, got %v", err)
+	}
+
+	if err := verify(signHS256(t, "first", "k1"), later); !errors.Is(err, ErrJWTSignature) {
+		t.Fatalf("expected the rotated out key not to verify, got %v", err)
+	}
+}
@@ -3,12 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Kong/go-pdk"
 	"github.com/Kong/go-pdk/server"
-	"github.com/itchyny/gojq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 )
@@ -27,6 +35,8 @@ var (
 var (
 	ErrorStatusCode        = "status code jq error"
 	ErrorStatusCodeInteger = "status code jq result is not an integer"
+	ErrorStatusCodeRange   = "status code jq result is not between 100 and 599"
+	ErrorStatusCodeReason  = "status code jq result reason is not a string"
 )
 
 var (
@@ -41,6 +51,11 @@ var (
 	ErrorQueryParamsMap    = "query params jq result is not a map"
 )
 
+var (
+	ErrorQueryParamsValue = "query params jq result values are not strings, numbers, booleans or lists of them"
+	ErrorHeadersValue     = "headers jq result values are not strings, numbers, booleans or lists of them"
+)
+
 var (
 	ErrorPathResult = "path jq doesn't return any result"
 	ErrorPath       = "path jq error"
@@ -53,6 +68,113 @@ var (
 	ErrorMethodString = "method jq result is not a string"
 )
 
+var (
+	ErrorRequestBodyResult   = "request body jq doesn't return any result"
+	ErrorRequestBody         = "request body jq error"
+	ErrorRequestBodyTooLarge = "request body is too large"
+)
+
+var (
+	ErrorRequestBodyEncoding  = "request body can't be decompressed"
+	ErrorRequestBodyCoding    = "request body content encoding is not supported"
+	ErrorResponseBodyTooLarge = "response body is too large"
+	ErrorResponseBodyEncoding = "response body can't be decompressed"
+)
+
+var (
+	ErrorRequestSchema         = "request schema error"
+	ErrorRequestSchemaInvalid  = "request doesn't match the request schema"
+	ErrorRequestSchemaError    = "request schema error jq error"
+	ErrorResponseSchema        = "response schema error"
+	ErrorResponseSchemaInvalid = "response doesn't match the response schema"
+)
+
+var (
+	ErrorCacheKey = "cache key jq error"
+	ErrorCacheTTL = "cache ttl jq error"
+)
+
+var (
+	ErrorJWTInvalid = "invalid bearer token"
+	ErrorJWTKeys    = "jwt keys error"
+)
+
+var (
+	ErrorSign       = "sign jq error"
+	ErrorSignResult = "sign jq result is not a string"
+	ErrorSignHMAC   = "request signature error"
+)
+
+var (
+	ErrorCORS       = "cors jq error"
+	ErrorCORSResult = "cors jq result is not an object with an allow_origin string"
+	ErrorCORSValue  = "cors jq result values are not of the expected types"
+)
+
+var (
+	ErrorRedirect         = "redirect jq error"
+	ErrorRedirectResult   = "redirect jq result is not an object with a location string"
+	ErrorRedirectStatus   = "redirect jq result status is not between 300 and 399"
+	ErrorRedirectLocation = "redirect location is not allowed"
+)
+
+var (
+	ErrorWhen      = "when jq error"
+	ErrorFieldWhen = "field when jq error"
+)
+
+var (
+	MetricsAddrEnv  = "KONG_JQ_METRICS_ADDR"  // when set, the plugin server serves /metrics on this address
+	OTLPEndpointEnv = "KONG_JQ_OTLP_ENDPOINT" // when set, the plugin server exports its spans to this OTLP/HTTP endpoint
+)
+
+var (
+	MetricProgramRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "kong_jq",
+			Name:      "program_runs_total",
+			Help:      "Number of jq program runs by phase, field, outcome and plugin instance.",
+		},
+		[]string{"phase", "field", "outcome", "instance"},
+	)
+	MetricProgramDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "kong_jq",
+			Name:      "program_duration_seconds",
+			Help:      "Duration of jq program runs by phase, field, outcome and plugin instance.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+		},
+		[]string{"phase", "field", "outcome", "instance"},
+	)
+)
+
+var (
+	MetricCompileCacheHits = promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "kong_jq",
+			Name:      "compile_cache_hits_total",
+			Help:      "Number of jq programs found already compiled.",
+		},
+		func() float64 { return float64(compileCacheHits.Load()) },
+	)
+	MetricCompileCacheMisses = promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "kong_jq",
+			Name:      "compile_cache_misses_total",
+			Help:      "Number of jq programs that had to be compiled.",
+		},
+		func() float64 { return float64(compileCacheMisses.Load()) },
+	)
+	MetricCompileCacheHitRatio = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "kong_jq",
+			Name:      "compile_cache_hit_ratio",
+			Help:      "Ratio of jq programs found already compiled since the plugin server started.",
+		},
+		compileCacheHitRatio,
+	)
+)
+
 var loggerKey = "logger"
 
 func ContextWithLog(ctx context.Context, fields logrus.Fields) (context.Context, *logrus.Entry) {
@@ -66,20 +188,117 @@ func ContextWithLog(ctx context.Context, fields logrus.Fields) (context.Context,
 	return context.WithValue(ctx, loggerKey, logger), logger
 }
 
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger := logrus.WithField("addr", addr)
+	logger.Info("serving metrics")
+
+	if err := http.ListenAndServe(addr, mux); err != nil { //nolint:gosec // local metrics endpoint, no timeouts needed
+		logger.WithError(err).Error("failed to serve metrics")
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	// kong runs the binary with -dump to get the plugin info, no need for metrics or traces then
+	if !lo.Contains(os.Args[1:], "-dump") {
+		if addr := os.Getenv(MetricsAddrEnv); addr != "" {
+			go serveMetrics(addr)
+		}
+
+		if endpoint := os.Getenv(OTLPEndpointEnv); endpoint != "" {
+			lo.Must0(initTracing(context.Background(), endpoint))
+		}
+	}
+
 	lo.Must0(server.StartServer(New, Version, Priority))
 }
 
 type Config struct {
 	Method         string // an optional jq query that returns a string to override the method (GET/POST/PUT/DELETE/PATCH)
 	Path           string // an optional jq query that returns a string to override the uri
-	QueryParams    string // jq query that returns an object of list of values
+	QueryParams    string // jq query that returns an object of list of values, a raw query string or a list of [key, value] pairs
 	RequestHeaders string // jq query that returns an object of list of values
 	RequestBody    string // jq query that returns a string reprensenting the new uri
 
 	ResponseHeaders string // jq query that returns an object of list of values
 	ResponseBody    string // an optional jq query that returns a string that will override the response body
-	StatusCode      string // an optional jq query returning an integer that will override the status code
+	StatusCode      string // an optional jq query returning an integer, or {code, reason}, that will override the status code, null keeping it
+
+	Debug       bool   `json:"debug"`        // add the jq contexts and program outputs to the response of requests carrying the debug secret
+	DebugHeader string `json:"debug_header"` // the request header carrying the debug secret, X-Kong-Jq-Debug by default
+	DebugSecret string `json:"debug_secret"` // the debug secret, debug is never honoured without it
+	DebugOutput string `json:"debug_output"` // headers (default) to add X-Kong-Jq-Debug headers, body to wrap the response in a JSON envelope
+
+	MaxRequestBodyBytes  int    `json:"max_request_body_bytes"`  // an optional size limit of the request body processed by jq
+	MaxResponseBodyBytes int    `json:"max_response_body_bytes"` // an optional size limit of the response body processed by jq
+	BodyLimitPolicy      string `json:"body_limit_policy"`       // what to do with a body over the limit: passthrough (default), reject or truncate-context
+
+	SkipResponseContentTypes []string `json:"skip_response_content_types"` // media types (text/* wildcards allowed) of the responses left untouched
+	SkipResponseLargerThan   int      `json:"skip_response_larger_than"`   // size in bytes above which responses are left untouched
+
+	DecodeBodies bool              `json:"decode_bodies"` // decode the bodies into request.json and response.json according to their Content-Type
+	OutputFormat map[string]string `json:"output_format"` // the format of the request_body and response_body results: json (default), raw, xml, yaml, form or csv
+	ETag         bool              `json:"etag"`          // set a strong ETag computed over the response body when it's replaced
+
+	CompressResponse bool `json:"compress_response"` // compress the replaced bodies of compressed upstream responses in the coding the client accepts, rather than sending them uncompressed
+
+	CacheKey           string `json:"cache_key"`             // an optional jq query returning the key responses are cached by, null or false to bypass the cache
+	CacheTTL           string `json:"cache_ttl"`             // an optional jq query returning for how many seconds a response is cached, Cache-Control max-age by default
+	CacheMaxEntries    int    `json:"cache_max_entries"`     // the maximum number of cached responses, 1000 by default
+	CacheMaxEntryBytes int    `json:"cache_max_entry_bytes"` // the maximum size of a cached response body, 1 MiB by default
+
+	RequestSchema        string `json:"request_schema"`         // an optional JSON schema request.json is validated against, invalid requests are rejected with a 400
+	RequestSchemaError   string `json:"request_schema_error"`   // an optional jq query rendering the 400 response body from the request and the schema violations
+	ResponseSchema       string `json:"response_schema"`        // an optional JSON schema the transformed response body is validated against
+	ResponseSchemaReject bool   `json:"response_schema_reject"` // reply with a 502 to invalid responses, rather than only logging them
+
+	ContextVersion int    `json:"context_version"` // the shape of the jq context, 1 (default) or 2, see JQContext
+	HeaderCase     string `json:"header_case"`     // the case of the header names in the context and of the ones jq returns: preserve (default), lower or canonical
+
+	JWT JWTConfig `json:"jwt"` // verify the bearer token of the requests and give its claims to the programs, see JWTConfig
+
+	Sign SignConfig `json:"sign"` // sign the requests sent to the upstream, see SignConfig
+
+	CORS string `json:"cors"` // an optional jq query returning {allow_origin, allow_methods, allow_headers, max_age, credentials}, null to leave CORS alone
+
+	Redirect      string   `json:"redirect"`       // an optional jq query returning {location, status} to redirect the request to, 302 by default, null to go on
+	RedirectHosts []string `json:"redirect_hosts"` // the hosts redirect locations may point to besides the request one, *.example.com wildcards allowed
+
+	When      string            `json:"when"`       // an optional jq predicate, evaluated in the access phase, the plugin is skipped when it's falsy
+	FieldWhen map[string]string `json:"field_when"` // optional jq predicates by field (method, path, response_body…), the field is skipped when its predicate is falsy
+
+	ProgramTimeoutMs int `json:"program_timeout_ms"` // an optional time limit of each jq program run in milliseconds, a program running over fails with a timeout
+
+	instance string // the key kong gives to this plugin instance, used to label metrics
+}
+
+// UnmarshalJSON decodes the configuration sent by kong, keeping the instance key along the way.
+func (conf *Config) UnmarshalJSON(data []byte) error {
+	type config Config
+
+	var meta struct {
+		Key string `json:"__key__"`
+	}
+
+	if err := json.Unmarshal(data, (*config)(conf)); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	conf.instance = meta.Key
+
+	return nil
 }
 
 func New() interface{} {
@@ -87,6 +306,10 @@ func New() interface{} {
 }
 
 func (conf Config) Access(kong *pdk.PDK) {
+	conf.access(fromPDK(kong))
+}
+
+func (conf Config) access(kong *Kong) {
 	ctx, logger := ContextWithLog(context.Background(), logrus.Fields{
 		"app":    "kong-jq",
 		"method": lo.Must(kong.Request.GetMethod()),
@@ -95,420 +318,734 @@ func (conf Config) Access(kong *pdk.PDK) {
 
 	headers := lo.Must(kong.Request.GetHeaders(-1))
 
-	args, kwargs := lo.Must2(kong.Request.GetUriCaptures())
+	ctx, span := startPhaseSpan(ctx, PhaseAccess, lo.Must(kong.Request.GetMethod()), lo.Must(kong.Request.GetPath()), headers)
+	defer span.End()
 
-	queryParams := lo.MapValues(
-		lo.Must(kong.Request.GetQuery(-1)),
-		func(s []string, _ string) any {
-			return lo.Map(
-				s,
-				func(s string, _ int) any {
-					return s
-				},
-			)
-		},
-	)
+	if conf.debugRequested(kong) {
+		var trace *debugTrace
 
-	arguments := map[string]any{
-		"request": map[string]any{
-			"method":       lo.Must(kong.Request.GetMethod()),
-			"path":         lo.Must(kong.Request.GetPath()),
-			"args":         lo.Map(args, func(s []byte, _ int) any { return string(s) }),
-			"kwargs":       lo.MapValues(kwargs, func(s []byte, _ string) any { return string(s) }),
-			"query_params": queryParams,
-			"headers": lo.MapValues(
-				headers,
-				func(s []string, _ string) any {
-					return lo.Map(
-						s,
-						func(s string, _ int) any {
-							return s
-						},
-					)
-				},
-			),
-		},
+		ctx, trace = ContextWithDebug(ctx, kong)
+
+		defer func() {
+			if err := trace.save(kong); err != nil {
+				logger.WithError(err).Error("failed to save debug trace")
+			}
+		}()
 	}
 
-	// logger = logger.WithField(
-	// 	"arguments",
-	// 	spew.Sdump(arguments),
-	// )
+	jqContext := conf.newContext(kong, PhaseAccess)
+
+	var jwtErr error // why the bearer token isn't verified, the policy applies once the when predicate lets the plugin run
+
+	if conf.JWT.enabled() {
+		claims, err := conf.JWT.verifyJWT(kong, time.Now())
 
-	if conf.Method != "" {
-		jqMethod := lo.Must(gojq.Parse(conf.Method))
+		jwtErr = err
+		jqContext.JWT = &JWTContext{Claims: lo.Ternary[any](err == nil, claims, nil)}
+
+		if err != nil {
+			jqContext.JWT.Error = err.Error()
+		}
 
-		iter := jqMethod.RunWithContext(ctx, arguments)
+		lo.Must0(saveJWTContext(kong, jqContext.JWT))
+	}
+
+	var upstreamBody any // the body sent to the upstream, as it's signed
+
+	if conf.needsRequestBody() {
+		body, size, err := conf.readRequestBody(kong)
+		if err != nil {
+			logger.WithError(err).Error("failed to get request body")
+			exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to get request body"), map[string][]string{})
+
+			return
+		}
+
+		// jq sees the request body decompressed, it's forwarded as it came unless it's replaced
+		if body != nil {
+			upstreamBody = string(body)
+
+			contentEncodingHeader, _ := kong.Request.GetHeader("content-encoding")
+
+			encoding, err := contentEncoding(contentEncodingHeader)
+			if err == nil {
+				body, err = decompressBody(encoding, body, conf.MaxRequestBodyBytes)
+			}
 
-		next, ok := iter.Next()
+			switch {
+			case errors.Is(err, ErrContentEncoding):
+				logger.WithError(err).Warn(ErrorRequestBodyCoding)
+				exit(ctx, conf, kong, http.StatusUnsupportedMediaType, []byte(ErrorRequestBodyCoding), map[string][]string{})
+
+				return
+			case errors.Is(err, ErrDecompressedBodyTooLarge):
+				logger.WithError(err).Error(ErrorRequestBodyTooLarge)
+				exit(ctx, conf, kong, http.StatusRequestEntityTooLarge, []byte(ErrorRequestBodyTooLarge), map[string][]string{})
+
+				return
+			case err != nil:
+				logger.WithError(err).Error(ErrorRequestBodyEncoding)
+				exit(ctx, conf, kong, http.StatusBadRequest, []byte(ErrorRequestBodyEncoding), map[string][]string{})
+
+				return
+			}
+
+			size = len(body)
+		}
+
+		requestBody, truncated, ok := conf.limitBody(logger.WithField("body", "request"), body, size, conf.MaxRequestBodyBytes)
 		if !ok {
-			logger.Error(ErrorMethodResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorMethodResult), map[string][]string{})
+			logger.Error(ErrorRequestBodyTooLarge)
+			exit(ctx, conf, kong, http.StatusRequestEntityTooLarge, []byte(ErrorRequestBodyTooLarge), map[string][]string{})
 
 			return
 		}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorMethod)
-			kong.Response.Exit(
+		jqContext.Request.BodyContext = &BodyContext{
+			Body:          requestBody,
+			BodyTruncated: truncated,
+			JSON: conf.decodedBody(
+				logger.WithField("body", "request"),
+				kong.Request.GetHeader,
+				requestBody,
+				truncated,
+			),
+		}
+	}
+
+	arguments := jqContext.Arguments()
+
+	if conf.When != "" {
+		run, err := evalPredicate(ctx, conf, PhaseAccess, FieldWhen, conf.When, arguments)
+		if err != nil {
+			logger.WithError(err).Error(ErrorWhen)
+			exit(
+				ctx, conf, kong,
 				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorMethod, err)),
+				[]byte(fmt.Sprintf("%s: %+v", ErrorWhen, err)),
 				map[string][]string{},
 			)
 
 			return
 		}
 
-		newMethod, ok := next.(string)
-		if !ok {
-			logger.Error(ErrorMethodString)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorMethodString), map[string][]string{})
+		if !run {
+			logger.Info("when predicate is falsy, skipping the plugin")
+			lo.Must0(kong.Ctx.SetShared(skippedSharedKey, true))
 
 			return
 		}
-
-		arguments["request"].(map[string]any)["method"] = newMethod
-		lo.Must0(kong.ServiceRequest.SetMethod(newMethod))
 	}
 
-	if conf.Path != "" {
-		jqPath := lo.Must(gojq.Parse(conf.Path))
+	corsHeaders := map[string][]string{} // the CORS headers of the actual response
 
-		iter := jqPath.RunWithContext(ctx, arguments)
+	if conf.CORS != "" {
+		cors, err := conf.evalCORS(ctx, arguments)
+		if err != nil {
+			failField(ctx, conf, kong, logger, err)
 
-		next, ok := iter.Next()
-		if !ok {
-			logger.Error(ErrorPathResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorPathResult), map[string][]string{})
+			return
+		}
+
+		if cors != nil && isPreflight(kong) {
+			logger.Info("answering CORS preflight")
+			exit(ctx, conf, kong, http.StatusNoContent, []byte{}, cors.headers(true))
 
 			return
 		}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorPath)
-			kong.Response.Exit(
-				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorPath, err)),
-				map[string][]string{},
-			)
+		if cors != nil {
+			corsHeaders = cors.headers(false)
+			lo.Must0(saveCORSHeaders(kong, corsHeaders))
+		}
+	}
+
+	// after the CORS preflights, which don't carry credentials, the keys failing to parse being a
+	// configuration error whatever the policy
+	if errors.Is(jwtErr, ErrJWTKeys) {
+		logger.WithError(jwtErr).Error(ErrorJWTKeys)
+		exit(ctx, conf, kong, http.StatusInternalServerError, []byte(ErrorJWTKeys), withCORSHeaders(map[string][]string{}, corsHeaders))
+
+		return
+	}
+
+	if jwtErr != nil && conf.JWT.Policy != JWTPolicyIgnore {
+		logger.WithError(jwtErr).Info(ErrorJWTInvalid)
+		exit(
+			ctx, conf, kong,
+			http.StatusUnauthorized,
+			[]byte(ErrorJWTInvalid),
+			withCORSHeaders(map[string][]string{"WWW-Authenticate": {`Bearer error="invalid_token"`}}, corsHeaders),
+		)
+
+		return
+	}
+
+	if conf.Redirect != "" {
+		location, status, err := conf.evalRedirect(ctx, kong, arguments)
+		if errors.Is(err, ErrRedirectLocation) {
+			logger.WithError(err).Warn(ErrorRedirectLocation)
+			exit(ctx, conf, kong, http.StatusBadRequest, []byte(ErrorRedirectLocation), withCORSHeaders(map[string][]string{}, corsHeaders))
 
 			return
 		}
 
-		newPath, ok := next.(string)
-		if !ok {
-			logger.Error(ErrorPathString)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorPathString), map[string][]string{})
+		if err != nil {
+			failField(ctx, conf, kong, logger, err)
 
 			return
 		}
 
-		arguments["request"].(map[string]any)["path"] = newPath
-		lo.Must0(kong.ServiceRequest.SetPath(newPath))
+		if location != "" {
+			logger.WithFields(logrus.Fields{"location": location, "status_code": status}).Info("redirecting")
+			exit(ctx, conf, kong, status, []byte{}, withCORSHeaders(map[string][]string{"Location": {location}}, corsHeaders))
+
+			return
+		}
 	}
 
-	if conf.QueryParams != "" {
-		jqQueryParams := lo.Must(gojq.Parse(conf.QueryParams))
+	// a nil body means it exceeds the limit and must be passed through
+	if conf.RequestSchema != "" && arguments["request"].(map[string]any)["body"] != nil {
+		violations, err := validateSchema(conf.RequestSchema, arguments["request"].(map[string]any)["json"])
+		if err != nil {
+			logger.WithError(err).Error(ErrorRequestSchema)
+			exit(
+				ctx, conf, kong,
+				http.StatusInternalServerError,
+				[]byte(fmt.Sprintf("%s: %+v", ErrorRequestSchema, err)),
+				map[string][]string{},
+			)
 
-		iter := jqQueryParams.RunWithContext(ctx, arguments)
+			return
+		}
 
-		next, ok := iter.Next()
-		if !ok {
-			logger.Error(ErrorQueryParamsResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorQueryParamsResult), map[string][]string{})
+		if len(violations) > 0 {
+			logger.WithField("violations", violations).Info(ErrorRequestSchemaInvalid)
+			conf.rejectInvalidRequest(ctx, logger, kong, arguments, violations)
 
 			return
 		}
+	}
+
+	if conf.CacheKey != "" {
+		state := cacheState{Status: CacheBypass}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorQueryParams)
-			kong.Response.Exit(
+		next, ok := runQuery(ctx, conf, PhaseAccess, FieldCacheKey, conf.CacheKey, arguments)
+		if err, isErr := next.(error); ok && isErr {
+			logger.WithError(err).Error(ErrorCacheKey)
+			exit(
+				ctx, conf, kong,
 				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorQueryParams, err)),
+				[]byte(fmt.Sprintf("%s: %+v", ErrorCacheKey, err)),
 				map[string][]string{},
 			)
 
 			return
 		}
 
-		newQueryParams, ok := next.(map[string]any) // jq results are forced to be map[string]any
-		if !ok {
-			logger.Error(ErrorQueryParamsMap)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorQueryParamsMap), map[string][]string{})
+		if key, ok := cacheKey(next); ok {
+			now := time.Now()
 
-			return
+			if entry, hit := conf.responseCache().get(key, now); hit {
+				logger.Info("serving cached response")
+				exit(ctx, conf, kong, entry.status, entry.body, withCORSHeaders(entry.cachedHeaders(now), corsHeaders))
+
+				return
+			}
+
+			state = cacheState{Key: key, Status: CacheMiss}
 		}
 
-		arguments["request"].(map[string]any)["query_params"] = newQueryParams
-		lo.Must0( // we want to bypass errors
-			kong.ServiceRequest.SetQuery( // we will set new query params
-				lo.MapValues( // we want to transform all values of query params that are []any at this time into []string
-					newQueryParams,
-					func(v any, _ string) []string {
-						return lo.Map( // we want to transform the []any into []string, currently the []any is represented as any above
-							v.([]any), // jq presents us a any type with we should be able to convert to []any
-							func(s any, _ int) string { // this any should be transformable into string
-								return s.(string)
-							},
-						)
-					},
-				),
-			),
-		)
-	} else {
-		lo.Must0(kong.ServiceRequest.SetQuery(map[string][]string{}))
+		lo.Must0(saveCacheState(kong, state))
 	}
 
-	allRequestHeaders := lo.Must(kong.Request.GetHeaders(-1))
-	for k := range allRequestHeaders {
-		kong.ServiceRequest.ClearHeader(k)
+	skipped, err := conf.skippedFields(ctx, PhaseAccess, arguments)
+	if err != nil {
+		logger.WithError(err).Error(ErrorFieldWhen)
+		exit(
+			ctx, conf, kong,
+			http.StatusInternalServerError,
+			[]byte(fmt.Sprintf("%s: %+v", ErrorFieldWhen, err)),
+			map[string][]string{},
+		)
+
+		return
 	}
 
-	if conf.RequestHeaders != "" {
-		jqRequestHeaders := lo.Must(gojq.Parse(conf.RequestHeaders))
+	upstreamHeaders, upstreamBody, err := conf.rewriteRequest(ctx, kong, arguments, skipped, upstreamBody)
+	if err != nil {
+		failField(ctx, conf, kong, logger, err)
 
-		iter := jqRequestHeaders.RunWithContext(ctx, arguments)
+		return
+	}
 
-		next, ok := iter.Next()
-		if !ok {
-			logger.Error(ErrorHeadersResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorHeadersResult), map[string][]string{})
+	// signed last, from the request as the other programs leave it
+	if conf.Sign.CanonicalString != "" {
+		signature, err := conf.evalSignature(ctx, conf.signingArguments(arguments, upstreamHeaders, upstreamBody))
+		if err != nil {
+			failField(ctx, conf, kong, logger, err)
 
 			return
 		}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorHeaders)
-			kong.Response.Exit(
-				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorHeaders, err)),
-				map[string][]string{},
-			)
+		lo.Must0(kong.ServiceRequest.SetHeader(conf.headerName(conf.Sign.header()), signature))
+	}
+}
 
-			return
+// rewriteRequest runs the request programs against the access phase context, setting the request
+// sent to the upstream, and returns the headers and the body it's sent with, as they are signed.
+// body is the request body as it came, nil when it isn't read. The error is a *FieldError.
+func (conf Config) rewriteRequest(
+	ctx context.Context,
+	kong *Kong,
+	arguments map[string]any,
+	skipped map[string]bool,
+	body any,
+) (map[string][]string, any, error) {
+	if conf.Method != "" && !skipped[FieldMethod] {
+		next, err := conf.evalField(ctx, PhaseAccess, FieldMethod, arguments)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		newRequestHeaders, ok := next.(map[string]any)
-		if !ok {
-			logger.Error(ErrorHeadersMap)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorHeadersMap), map[string][]string{})
+		newMethod := next.(string)
 
-			return
+		arguments["request"].(map[string]any)["method"] = newMethod
+		lo.Must0(kong.ServiceRequest.SetMethod(newMethod))
+	}
+
+	if conf.Path != "" && !skipped[FieldPath] {
+		next, err := conf.evalField(ctx, PhaseAccess, FieldPath, arguments)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		for k, v := range newRequestHeaders {
-			logger := logger.WithFields(logrus.Fields{
-				"header key":   k,
-				"header value": v,
-			})
+		newPath := next.(string)
 
-			if values, ok := v.([]any); ok {
-				for _, value := range values {
-					if value, ok := value.(string); ok {
-						lo.Must0(kong.ServiceRequest.AddHeader(k, value))
-					} else {
-						logger.Error("header value is not a string")
-						kong.Response.Exit(http.StatusInternalServerError, []byte("header value is not a string"), map[string][]string{})
+		arguments["request"].(map[string]any)["path"] = newPath
+		lo.Must0(kong.ServiceRequest.SetPath(newPath))
+	}
 
-						return
-					}
-				}
-			} else {
-				if value, ok := v.(string); ok {
-					lo.Must0(kong.ServiceRequest.SetHeader(k, value))
-				} else {
-					logger.Error("header value is not a string or a list of strings")
-					kong.Response.Exit(http.StatusInternalServerError, []byte("header value is not a string or a list of strings"), map[string][]string{})
+	if conf.QueryParams != "" && !skipped[FieldQueryParams] {
+		next, err := conf.evalField(ctx, PhaseAccess, FieldQueryParams, arguments)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch next := next.(type) {
+		case string: // a raw query string, pairs being encoded into one to keep their order
+			newQueryParams, _ := url.ParseQuery(next)
+
+			arguments["request"].(map[string]any)["query_params"] = multimapArgument(newQueryParams)
+			arguments["request"].(map[string]any)["raw_query"] = next
+			lo.Must0(kong.ServiceRequest.SetRawQuery(next))
+		case Multimap:
+			newQueryParams := next.Values // the query is replaced, a removed param is one left out
+
+			arguments["request"].(map[string]any)["query_params"] = multimapArgument(newQueryParams)
+			arguments["request"].(map[string]any)["raw_query"] = url.Values(newQueryParams).Encode()
+			lo.Must0(kong.ServiceRequest.SetQuery(newQueryParams))
+		}
+	} else if !skipped[FieldQueryParams] {
+		lo.Must0(kong.ServiceRequest.SetQuery(map[string][]string{}))
+	}
+
+	explicitContentType := false // whether the request headers program sets the content type of the request body
+
+	upstreamHeaders := lo.Must(kong.Request.GetHeaders(-1))
+
+	// the request headers are the ones returned by jq, unless the program is skipped
+	if !skipped[FieldRequestHeaders] {
+		for k := range upstreamHeaders {
+			kong.ServiceRequest.ClearHeader(k)
+		}
+
+		upstreamHeaders = map[string][]string{}
+	}
+
+	if conf.RequestHeaders != "" && !skipped[FieldRequestHeaders] {
+		next, err := conf.evalField(ctx, PhaseAccess, FieldRequestHeaders, arguments)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newRequestHeaders := next.(Multimap).Values
+
+		for _, k := range next.(Multimap).Removed {
+			lo.Must0(kong.ServiceRequest.ClearHeader(k))
+		}
 
-					return
+		for k, values := range newRequestHeaders {
+			for i, value := range values {
+				if i == 0 {
+					lo.Must0(kong.ServiceRequest.SetHeader(conf.headerName(k), value))
+				} else {
+					lo.Must0(kong.ServiceRequest.AddHeader(conf.headerName(k), value))
 				}
 			}
 		}
+
+		explicitContentType = hasHeader(newRequestHeaders, "Content-Type")
+		upstreamHeaders = lowerKeys(newRequestHeaders)
+	}
+
+	// a nil body means it exceeds the limit and must be passed through
+	if conf.RequestBody != "" && arguments["request"].(map[string]any)["body"] != nil && !skipped[FieldRequestBody] {
+		next, err := conf.evalField(ctx, PhaseAccess, FieldRequestBody, arguments)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newRequestBody := next.(encodedBody).Bytes
+
+		// cleared first, setting the body sets its Content-Length
+		for _, k := range StaleBodyHeaders {
+			lo.Must0(kong.ServiceRequest.ClearHeader(k))
+		}
+
+		lo.Must0(kong.ServiceRequest.SetRawBody(string(newRequestBody)))
+
+		upstreamHeaders = lo.OmitByKeys(upstreamHeaders, lo.Map(StaleBodyHeaders, func(k string, _ int) string { return strings.ToLower(k) }))
+		upstreamHeaders["content-length"] = []string{strconv.Itoa(len(newRequestBody))}
+		body = string(newRequestBody)
+
+		if !explicitContentType {
+			lo.Must0(kong.ServiceRequest.SetHeader("Content-Type", contentTypeOf(conf.OutputFormat[FieldRequestBody])))
+			upstreamHeaders["content-type"] = []string{contentTypeOf(conf.OutputFormat[FieldRequestBody])}
+		}
 	}
+
+	return upstreamHeaders, body, nil
 }
 
 func (conf Config) Response(kong *pdk.PDK) {
+	conf.response(fromPDK(kong))
+}
+
+func (conf Config) response(kong *Kong) {
 	ctx, logger := ContextWithLog(context.Background(), logrus.Fields{
 		"app":    "kong-jq",
 		"method": lo.Must(kong.Request.GetMethod()),
 		"path":   lo.Must(kong.Request.GetPath()),
 	})
 
-	args, kwargs := lo.Must2(kong.Request.GetUriCaptures())
-
-	queryParams := lo.MapValues(
-		lo.Must(kong.Request.GetQuery(-1)),
-		func(s []string, _ string) any {
-			return lo.Map(
-				s,
-				func(s string, _ int) any {
-					return s
-				},
-			)
-		},
+	ctx, span := startPhaseSpan(
+		ctx,
+		PhaseResponse,
+		lo.Must(kong.Request.GetMethod()),
+		lo.Must(kong.Request.GetPath()),
+		lo.Must(kong.Request.GetHeaders(-1)),
 	)
+	defer span.End()
+
+	debug := conf.debugRequested(kong)
+	if debug {
+		ctx, _ = ContextWithDebug(ctx, kong)
+	}
+
+	// the when predicate of the access phase skipped the plugin for this request
+	if skip, _ := kong.Ctx.GetSharedAny(skippedSharedKey); skip == true {
+		return
+	}
+
+	// the responses left untouched get the CORS headers too, the ones replaced below get them again
+	corsHeaders := loadCORSHeaders(kong)
+
+	if err := setCORSHeaders(kong, corsHeaders); err != nil {
+		logger.WithError(err).Error("failed to set CORS headers")
+		exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to set CORS headers"), map[string][]string{})
+
+		return
+	}
+
+	// kong buffers the response anyway, the least we can do is to leave it alone
+	if !conf.transformsResponse() && !debug {
+		return
+	}
+
+	if reason := conf.skipResponse(kong); reason != "" {
+		logger.WithField("reason", reason).Info("skipping response processing")
 
-	allResponseHeaders, err := kong.Response.GetHeaders(-1)
+		return
+	}
+
+	statusCode := lo.Must(kong.ServiceResponse.GetStatus())
+
+	// a nil body is one its Content-Length tells is over the limit, it's left to the upstream response
+	body, size, err := conf.readResponseBody(kong)
 	if err != nil {
-		logger.WithError(err).Error("failed to get all response headers")
-		kong.Response.Exit(
-			http.StatusInternalServerError,
-			[]byte("failed to get all response headers"),
-			map[string][]string{},
-		)
+		logger.WithError(err).Error("failed to get response body")
+		exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to get response body"), map[string][]string{})
+
+		return
+	}
+
+	if conf.SkipResponseLargerThan > 0 && size > conf.SkipResponseLargerThan {
+		logger.WithField("reason", "size").Info("skipping response processing")
 
 		return
 	}
 
-	logger.WithField("response_headers_count", len(allResponseHeaders)).Info("clearing response headers…")
+	// jq sees the response body decompressed, unless it's encoded in a coding we don't support
+	contentEncodingHeader, _ := kong.ServiceResponse.GetHeader("content-encoding")
+
+	encoding, err := contentEncoding(contentEncodingHeader)
+	unsupportedEncoding := err != nil
+	decoded := body
+
+	if !unsupportedEncoding && body != nil {
+		decoded, err = decompressBody(encoding, body, conf.MaxResponseBodyBytes)
+		if errors.Is(err, ErrDecompressedBodyTooLarge) {
+			logger.WithError(err).Error(ErrorResponseBodyTooLarge)
+			exit(ctx, conf, kong, http.StatusBadGateway, []byte(ErrorResponseBodyTooLarge), map[string][]string{})
 
-	for k := range allResponseHeaders {
-		logger.WithField("header", k).Info("clearing header")
+			return
+		}
 
-		if err := kong.Response.ClearHeader(k); err != nil {
-			logger.WithError(err).Error("failed to clear header")
-			kong.Response.Exit(http.StatusInternalServerError, []byte("failed to clear header"), map[string][]string{})
+		if err != nil {
+			logger.WithError(err).Error(ErrorResponseBodyEncoding)
+			exit(ctx, conf, kong, http.StatusBadGateway, []byte(ErrorResponseBodyEncoding), map[string][]string{})
 
 			return
 		}
+
+		size = len(decoded)
 	}
 
-	statusCode := lo.Must(kong.ServiceResponse.GetStatus())
-	body := lo.Must(kong.ServiceResponse.GetRawBody())
-
-	arguments := map[string]any{
-		"request": map[string]any{
-			"method":       lo.Must(kong.Request.GetMethod()),
-			"path":         lo.Must(kong.Request.GetPath()),
-			"args":         lo.Map(args, func(s []byte, _ int) any { return string(s) }),
-			"kwargs":       lo.MapValues(kwargs, func(s []byte, _ string) any { return string(s) }),
-			"query_params": queryParams,
-		},
-		"response": map[string]any{
-			"headers":     map[string]any{},
-			"body":        string(body),
-			"status_code": statusCode,
+	responseBody, truncated, ok := conf.limitBody(logger.WithField("body", "response"), decoded, size, conf.MaxResponseBodyBytes)
+	if !ok {
+		logger.Error(ErrorResponseBodyTooLarge)
+		exit(ctx, conf, kong, http.StatusBadGateway, []byte(ErrorResponseBodyTooLarge), map[string][]string{})
+
+		return
+	}
+
+	// passed through over the limit, a compressed body is forwarded as it came
+	keepEncoding := unsupportedEncoding || responseBody == nil
+	if !keepEncoding {
+		body = decoded
+	}
+
+	jqContext := conf.newContext(kong, PhaseResponse)
+	if conf.JWT.enabled() {
+		jqContext.JWT = loadJWTContext(kong)
+	}
+
+	jqContext.Response = &ResponseContext{
+		StatusCode: statusCode,
+		Headers:    map[string][]string{},
+		BodyContext: &BodyContext{
+			Body:          responseBody,
+			BodyTruncated: truncated,
+			JSON: conf.decodedBody(
+				logger.WithField("body", "response"),
+				kong.ServiceResponse.GetHeader,
+				responseBody,
+				truncated,
+			),
 		},
 	}
 
-	headers := map[string][]string{}
+	if conf.contextVersion() >= ContextV2 {
+		jqContext.Response.Headers = conf.normalizeHeaders(lo.Must(kong.ServiceResponse.GetHeaders(-1)))
+	}
 
-	if conf.ResponseHeaders != "" {
-		jqResponseHeaders := lo.Must(gojq.Parse(conf.ResponseHeaders))
-		iter := jqResponseHeaders.RunWithContext(ctx, arguments)
+	arguments := jqContext.Arguments()
 
-		next, ok := iter.Next()
-		if !ok {
-			logger.Error(ErrorHeadersResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorHeadersResult), map[string][]string{})
+	skipped, err := conf.skippedFields(ctx, PhaseResponse, arguments)
+	if err != nil {
+		logger.WithError(err).Error(ErrorFieldWhen)
+		exit(
+			ctx, conf, kong,
+			http.StatusInternalServerError,
+			[]byte(fmt.Sprintf("%s: %+v", ErrorFieldWhen, err)),
+			map[string][]string{},
+		)
 
-			return
-		}
+		return
+	}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorHeaders)
-			kong.Response.Exit(
+	// the response headers are the ones returned by jq, unless there is no response headers program
+	// or it's skipped, the upstream ones being kept then
+	keepHeaders := conf.ResponseHeaders == "" || skipped[FieldResponseHeaders]
+
+	if !keepHeaders {
+		allResponseHeaders, err := kong.Response.GetHeaders(-1)
+		if err != nil {
+			logger.WithError(err).Error("failed to get all response headers")
+			exit(
+				ctx, conf, kong,
 				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorHeaders, err)),
+				[]byte("failed to get all response headers"),
 				map[string][]string{},
 			)
 
 			return
 		}
 
-		newResponseHeaders, ok := next.(map[string]any)
-		if !ok {
-			logger.Error(ErrorHeadersMap)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorHeadersMap), map[string][]string{})
+		logger.WithField("response_headers_count", len(allResponseHeaders)).Info("clearing response headers…")
+
+		for k := range allResponseHeaders {
+			logger.WithField("header", k).Info("clearing header")
+
+			if err := kong.Response.ClearHeader(k); err != nil {
+				logger.WithError(err).Error("failed to clear header")
+				exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to clear header"), map[string][]string{})
+
+				return
+			}
+		}
+	}
+
+	headers := map[string][]string{}
+
+	if conf.ResponseHeaders != "" && !skipped[FieldResponseHeaders] {
+		next, err := conf.evalField(ctx, PhaseResponse, FieldResponseHeaders, arguments)
+		if err != nil {
+			failField(ctx, conf, kong, logger, err)
 
 			return
 		}
 
-		headers = lo.MapValues(
-			newResponseHeaders,
-			func(s any, _ string) []string {
-				return lo.Map(
-					s.([]any),
-					func(s any, _ int) string {
-						return s.(string)
-					},
-				)
-			},
-		)
+		for _, k := range next.(Multimap).Removed {
+			if err := kong.Response.ClearHeader(k); err != nil {
+				logger.WithError(err).Error("failed to clear header")
+				exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to clear header"), map[string][]string{})
+
+				return
+			}
+		}
+
+		headers = conf.normalizeHeaders(next.(Multimap).Values)
 	}
 
-	if conf.StatusCode != "" {
-		jqStatusCode := lo.Must(gojq.Parse(conf.StatusCode))
-		iter := jqStatusCode.RunWithContext(ctx, arguments)
+	if conf.StatusCode != "" && !skipped[FieldStatusCode] {
+		next, err := conf.evalField(ctx, PhaseResponse, FieldStatusCode, arguments)
+		if err != nil {
+			failField(ctx, conf, kong, logger, err)
 
-		next, ok := iter.Next()
-		if !ok {
-			logger.Error(ErrorStatusCodeResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorStatusCodeResult), map[string][]string{})
+			return
+		}
+
+		// a zero code is a null result, keeping the upstream status
+		if status := next.(Status); status.Code != 0 {
+			logger.WithFields(logrus.Fields{"status_code": status.Code, "reason": status.Reason}).Info("overriding status code")
+
+			statusCode = status.Code
+		}
+	}
+
+	bodyReplaced := false
+	transformedBody := arguments["response"].(map[string]any)["json"] // the body as validated against the response schema
+
+	// a nil body means it exceeds the limit and must be passed through
+	if conf.ResponseBody != "" && responseBody != nil && !skipped[FieldResponseBody] {
+		next, err := conf.evalField(ctx, PhaseResponse, FieldResponseBody, arguments)
+		if err != nil {
+			failField(ctx, conf, kong, logger, err)
 
 			return
 		}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorStatusCode)
-			kong.Response.Exit(
+		body = next.(encodedBody).Bytes
+		bodyReplaced = true
+		transformedBody = next.(encodedBody).Value
+	}
+
+	// a nil body means it exceeds the limit and jq never got to see it
+	if conf.ResponseSchema != "" && (bodyReplaced || responseBody != nil) {
+		violations, err := validateSchema(conf.ResponseSchema, transformedBody)
+		if err != nil {
+			logger.WithError(err).Error(ErrorResponseSchema)
+			exit(
+				ctx, conf, kong,
 				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorStatusCode, err)),
+				[]byte(fmt.Sprintf("%s: %+v", ErrorResponseSchema, err)),
 				map[string][]string{},
 			)
 
 			return
 		}
 
-		newStatusCode, ok := next.(int)
-		if !ok {
-			logger.Error(ErrorStatusCodeInteger)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorStatusCodeInteger), map[string][]string{})
+		if len(violations) > 0 {
+			logger.WithField("violations", violations).Warn(ErrorResponseSchemaInvalid)
 
-			return
+			if conf.ResponseSchemaReject {
+				exit(ctx, conf, kong, http.StatusBadGateway, []byte(ErrorResponseSchemaInvalid), map[string][]string{})
+
+				return
+			}
+		}
+	}
+
+	if bodyReplaced {
+		// the upstream headers are still there when they are kept
+		for _, k := range StaleBodyHeaders {
+			if err := kong.Response.ClearHeader(k); err != nil {
+				logger.WithError(err).Error("failed to clear header")
+				exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to clear header"), map[string][]string{})
+
+				return
+			}
 		}
 
-		statusCode = newStatusCode
+		headers = conf.replacedBodyHeaders(conf.OutputFormat[FieldResponseBody], headers, body)
 	}
 
-	if conf.ResponseBody != "" {
-		jqResponseBody := lo.Must(gojq.Parse(conf.ResponseBody))
+	if conf.CacheKey != "" {
+		if state, ok := loadCacheState(kong); ok {
+			headers[CacheHeader] = []string{state.Status}
 
-		iter := jqResponseBody.RunWithContext(ctx, arguments)
+			// responses are cached uncompressed, unless they are passed through as they came
+			if state.Status == CacheMiss && body != nil && !(keepEncoding && contentEncodingHeader != "") {
+				cachedHeaders := headers
 
-		next, ok := iter.Next()
-		if !ok {
-			logger.Error(ErrorResponseBodyResult)
-			kong.Response.Exit(http.StatusInternalServerError, []byte(ErrorResponseBodyResult), map[string][]string{})
+				// the upstream headers left on the response are cached along
+				if keepHeaders {
+					cachedHeaders = lo.Assign(lo.Must(kong.ServiceResponse.GetHeaders(-1)), headers)
+				}
 
-			return
+				cachedHeaders = conf.cachedResponseHeaders(cachedHeaders, body, contentEncodingHeader == "" && !bodyReplaced, bodyReplaced)
+
+				conf.storeResponse(ctx, logger, kong, arguments, state.Key, statusCode, body, cachedHeaders)
+			}
 		}
+	}
 
-		if err, ok := next.(error); ok {
-			logger.WithError(err).Error(ErrorResponseBody)
-			kong.Response.Exit(
-				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorResponseBody, err)),
-				map[string][]string{},
-			)
+	// the upstream Vary is kept along with the upstream headers, setting the CORS one adds to it
+	if keepHeaders && !hasHeader(headers, "Vary") {
+		if vary := headerValuesOf(lo.Must(kong.ServiceResponse.GetHeaders(-1)), "Vary"); len(vary) > 0 {
+			headers["Vary"] = vary
+		}
+	}
 
-			return
+	headers = withCORSHeaders(headers, corsHeaders)
+
+	// an untouched body is left to the upstream response rather than replaced with an exit, so that the
+	// plugins running after this one handle the response as usual
+	if !bodyReplaced {
+		if err := pass(ctx, conf, kong, statusCode, body, upstreamBodyHeaders(kong, headers)); err != nil {
+			logger.WithError(err).Error("failed to set response")
+			exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to set response"), map[string][]string{})
 		}
 
-		var err error
+		return
+	}
 
-		body, err = json.Marshal(next)
+	if contentEncodingHeader != "" {
+		headers, body, err = conf.encodeResponseBody(
+			kong,
+			headers,
+			body,
+			lo.Ternary(unsupportedEncoding, contentEncodingHeader, encoding),
+		)
 		if err != nil {
-			logger.WithError(err).Error(ErrorResponseBody)
-			kong.Response.Exit(
-				http.StatusInternalServerError,
-				[]byte(fmt.Sprintf("%s: %+v", ErrorResponseBody, err)),
-				map[string][]string{},
-			)
+			logger.WithError(err).Error("failed to encode response body")
+			exit(ctx, conf, kong, http.StatusInternalServerError, []byte("failed to encode response body"), map[string][]string{})
 
 			return
 		}
 	}
 
-	kong.Response.Exit(statusCode, body, headers)
+	exit(ctx, conf, kong, statusCode, body, headers)
 }
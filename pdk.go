@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/Kong/go-pdk"
+	"github.com/Kong/go-pdk/entities"
+)
+
+// Kong is the part of the Kong PDK the plugin uses, so that it can run against something else
+// than a live Kong: the in-memory fake of the test subcommand for instance.
+type Kong struct {
+	Request         Request
+	ServiceRequest  ServiceRequest
+	Response        Response
+	ServiceResponse ServiceResponse
+	Ctx             Ctx
+	Client          Client
+	Router          Router
+}
+
+// Request is the client request, as kong.Request.
+type Request interface {
+	GetForwardedScheme() (string, error)
+	GetForwardedHost() (string, error)
+	GetForwardedPort() (int, error)
+	GetMethod() (string, error)
+	GetPath() (string, error)
+	GetQuery(maxArgs int) (map[string][]string, error)
+	GetRawQuery() (string, error)
+	GetHeader(k string) (string, error)
+	GetHeaders(maxHeaders int) (map[string][]string, error)
+	GetRawBody() ([]byte, error)
+	GetUriCaptures() ([][]byte, map[string][]byte, error)
+}
+
+// ServiceRequest is the request sent to the upstream, as kong.ServiceRequest.
+type ServiceRequest interface {
+	SetMethod(method string) error
+	SetPath(path string) error
+	SetQuery(query map[string][]string) error
+	SetRawQuery(query string) error
+	SetHeader(name string, value string) error
+	AddHeader(name string, value string) error
+	ClearHeader(name string) error
+	SetRawBody(body string) error
+}
+
+// Response is the response sent to the client, as kong.Response.
+type Response interface {
+	GetHeaders(maxHeaders int) (map[string][]string, error)
+	SetStatus(status int) error
+	SetHeader(k string, v string) error
+	AddHeader(k string, v string) error
+	ClearHeader(k string) error
+	Exit(status int, body []byte, headers map[string][]string)
+}
+
+// ServiceResponse is the response of the upstream, as kong.ServiceResponse.
+type ServiceResponse interface {
+	GetStatus() (int, error)
+	GetHeader(name string) (string, error)
+	GetHeaders(maxHeaders int) (map[string][]string, error)
+	GetRawBody() ([]byte, error)
+}
+
+// Ctx holds the values shared by the phases of a request, as kong.Ctx.
+type Ctx interface {
+	SetShared(k string, value any) error
+	GetSharedAny(k string) (any, error)
+	GetSharedString(k string) (string, error)
+}
+
+// Client is the client of the request, as kong.Client.
+type Client interface {
+	GetConsumer() (entities.Consumer, error)
+}
+
+// Router is the route matched by the request, as kong.Router.
+type Router interface {
+	GetRoute() (entities.Route, error)
+}
+
+func fromPDK(kong *pdk.PDK) *Kong {
+	return &Kong{
+		Request:         kong.Request,
+		ServiceRequest:  kong.ServiceRequest,
+		Response:        kong.Response,
+		ServiceResponse: kong.ServiceResponse,
+		Ctx:             kong.Ctx,
+		Client:          kong.Client,
+		Router:          kong.Router,
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// ErrRedirectLocation is the error of a location redirect_hosts doesn't allow, which is usually
+// built from the request, hence a client error.
+var ErrRedirectLocation = errors.New(ErrorRedirectLocation)
+
+// evalRedirect runs the redirect program, returning the absolute location and the status to
+// redirect the request with, or an empty location when the program returns null. The error is a
+// *FieldError, or an ErrRedirectLocation when the location isn't allowed.
+func (conf Config) evalRedirect(ctx context.Context, kong *Kong, arguments map[string]any) (string, int, error) {
+	next, ok := runQuery(ctx, conf, PhaseAccess, FieldRedirect, conf.Redirect, arguments)
+	if !ok || next == nil {
+		return "", 0, nil
+	}
+
+	if err, ok := next.(error); ok {
+		return "", 0, &FieldError{Message: ErrorRedirect, Err: err}
+	}
+
+	m, _ := next.(map[string]any)
+
+	location, ok := m["location"].(string)
+	if !ok || location == "" {
+		return "", 0, &FieldError{Message: ErrorRedirectResult}
+	}
+
+	status := http.StatusFound
+
+	if m["status"] != nil {
+		code, err := coerceStatusCode(m["status"])
+		if err != nil || code < 300 || code > 399 {
+			return "", 0, &FieldError{Message: ErrorRedirectStatus}
+		}
+
+		status = code
+	}
+
+	location, err := conf.redirectLocation(kong, location)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return location, status, nil
+}
+
+// requestURL returns the URL the client requested, as seen through the proxies kong trusts.
+func requestURL(kong *Kong) *url.URL {
+	scheme := lo.Must(kong.Request.GetForwardedScheme())
+	host := lo.Must(kong.Request.GetForwardedHost())
+
+	// the default port of the scheme is left out
+	if port := lo.Must(kong.Request.GetForwardedPort()); port != 0 && port != map[string]int{"http": 80, "https": 443}[scheme] {
+		host += ":" + strconv.Itoa(port)
+	}
+
+	return &url.URL{Scheme: scheme, Host: host, Path: lo.Must(kong.Request.GetPath())}
+}
+
+// redirectLocation resolves a redirect location against the URL of the request. An absolute
+// location must point to the request host or to one of redirect_hosts, so that a location built
+// from the request can't send the client anywhere.
+func (conf Config) redirectLocation(kong *Kong, location string) (string, error) {
+	reference, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrRedirectLocation, err)
+	}
+
+	base := requestURL(kong)
+	target := base.ResolveReference(reference)
+
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return "", fmt.Errorf("%w: scheme %q is not http or https", ErrRedirectLocation, target.Scheme)
+	}
+
+	if !strings.EqualFold(target.Hostname(), base.Hostname()) && !conf.redirectHostAllowed(target.Hostname()) {
+		return "", fmt.Errorf("%w: host %q is not in redirect_hosts", ErrRedirectLocation, target.Hostname())
+	}
+
+	return target.String(), nil
+}
+
+// redirectHostAllowed tells whether redirect_hosts allows a host, *.example.com allowing the
+// subdomains of example.com.
+func (conf Config) redirectHostAllowed(host string) bool {
+	host = strings.ToLower(host)
+
+	return lo.SomeBy(conf.RedirectHosts, func(allowed string) bool {
+		allowed = strings.ToLower(allowed)
+
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok && strings.HasPrefix(suffix, ".") {
+			return strings.HasSuffix(host, suffix)
+		}
+
+		return host == allowed
+	})
+}
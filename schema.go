@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/samber/lo"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	schemaURL           = "https://kong-jq-plugin/schema.json" // the schemas are given inline, they are never fetched
+	schemaSummaryPrefix = "doesn't validate with"              // the message of the violations only summing up the ones under them
+)
+
+// compiledSchemas caches the compiled JSON schemas by their source, like compiledQueries
+var compiledSchemas sync.Map
+
+func compileSchema(source string) (*jsonschema.Schema, error) {
+	if schema, ok := compiledSchemas.Load(source); ok {
+		return schema.(*jsonschema.Schema), nil
+	}
+
+	schema, err := jsonschema.CompileString(schemaURL, source)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledSchemas.Store(source, schema)
+
+	return schema, nil
+}
+
+// validateSchema validates a jq value against a JSON schema, returning the violations as jq values
+// {path, keyword, message}, none when the value is valid.
+func validateSchema(source string, v any) ([]any, error) {
+	schema, err := compileSchema(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// round tripped so that the validator gets the types it expects, big integers included
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var validationErr *jsonschema.ValidationError
+
+	if err := schema.Validate(value); errors.As(err, &validationErr) {
+		return lo.FilterMap(validationErr.BasicOutput().Errors, func(e jsonschema.BasicError, _ int) (any, bool) {
+			return map[string]any{
+				"path":    e.InstanceLocation,
+				"keyword": e.KeywordLocation,
+				"message": e.Error,
+			}, e.Error != "" && !strings.HasPrefix(e.Error, schemaSummaryPrefix)
+		}), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// rejectInvalidRequest replies with a 400 listing the schema violations, rendered by the request
+// schema error query when there is one.
+func (conf Config) rejectInvalidRequest(
+	ctx context.Context,
+	logger *logrus.Entry,
+	kong *Kong,
+	arguments map[string]any,
+	violations []any,
+) {
+	var body any = map[string]any{
+		"message":    ErrorRequestSchemaInvalid,
+		"violations": violations,
+	}
+
+	if conf.RequestSchemaError != "" {
+		next, ok := runQuery(ctx, conf, PhaseAccess, FieldRequestSchemaError, conf.RequestSchemaError, map[string]any{
+			"request":    arguments["request"],
+			"violations": violations,
+		})
+
+		switch err, isErr := next.(error); {
+		case !ok:
+			logger.Error(ErrorRequestSchemaError)
+		case isErr:
+			logger.WithError(err).Error(ErrorRequestSchemaError)
+		default:
+			body = next
+		}
+	}
+
+	exit(
+		ctx, conf, kong,
+		http.StatusBadRequest,
+		lo.Must(json.Marshal(body)),
+		map[string][]string{"Content-Type": {FormatContentTypes[FormatJSON]}},
+	)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// hopByHopHeaders are the headers of a connection rather than of a message, a proxy doesn't forward them.
+var hopByHopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// Proxy runs the plugin in front of an upstream like kong does: the access phase, the upstream,
+// then the response phase.
+type Proxy struct {
+	conf     Config
+	upstream *url.URL
+	client   *http.Client
+}
+
+func NewProxy(conf Config, upstream *url.URL) *Proxy {
+	return &Proxy{
+		conf:     conf,
+		upstream: upstream,
+		client: &http.Client{
+			// the plugin gets the bodies as they come, like it does behind kong
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableCompression: true},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Timeout: 60 * time.Second,
+		},
+	}
+}
+
+// forwardedHeaders drops the headers the proxy doesn't forward, along with the ones it sets itself.
+func forwardedHeaders(headers map[string][]string) map[string][]string {
+	return lo.OmitByKeys(lowerKeys(headers), append([]string{"host", "content-length"}, hopByHopHeaders...))
+}
+
+// roundTrip sends the request as the access phase leaves it to the upstream.
+func (p *Proxy) roundTrip(ctx context.Context, request HTTPRequest) (HTTPResponse, error) {
+	target := p.upstream.JoinPath(request.Path)
+	target.RawQuery = request.rawQuery()
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, target.String(), strings.NewReader(request.Body))
+	if err != nil {
+		return HTTPResponse{}, err
+	}
+
+	req.Header = http.Header(forwardedHeaders(request.Headers))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return HTTPResponse{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return HTTPResponse{}, err
+	}
+
+	return HTTPResponse{Status: res.StatusCode, Headers: res.Header, Body: string(body)}, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := logrus.WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path})
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.WithError(err).Error("failed to read request body")
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+
+		return
+	}
+
+	headers := lowerKeys(r.Header)
+	headers["host"] = []string{r.Host}
+
+	_, response, err := p.conf.Play(
+		HTTPRequest{
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Query:    r.URL.Query(),
+			RawQuery: r.URL.RawQuery,
+			Headers:  headers,
+			Body:     string(body),
+		},
+		func(request HTTPRequest) (HTTPResponse, error) {
+			return p.roundTrip(r.Context(), request)
+		},
+	)
+	if err != nil {
+		logger.WithError(err).Error("failed to reach the upstream")
+		http.Error(w, "An invalid response was received from the upstream server", http.StatusBadGateway)
+
+		return
+	}
+
+	for k, values := range forwardedHeaders(response.Headers) {
+		for _, value := range values {
+			w.Header().Add(k, value)
+		}
+	}
+
+	w.WriteHeader(response.Status)
+
+	if _, err := io.Copy(w, bytes.NewReader([]byte(response.Body))); err != nil {
+		logger.WithError(err).Warn("failed to write response body")
+	}
+}
+
+// runServeCommand serves a reverse proxy running the plugin in front of an upstream, until it's
+// interrupted.
+//
+//	kong-jq-plugin serve --config plugin.yaml --upstream http://localhost:8080 --listen :9000
+func runServeCommand(args []string, _, stderr io.Writer) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "", "the plugin configuration file, YAML or JSON")
+	upstream := flags.String("upstream", "", "the upstream base URL, such as http://localhost:8080")
+	listen := flags.String("listen", ":9000", "the address to listen on")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *configPath == "" || *upstream == "" {
+		fmt.Fprintln(stderr, "usage: kong-jq-plugin serve --config plugin.yaml --upstream http://localhost:8080 [--listen :9000]")
+
+		return 2
+	}
+
+	conf, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+
+		return 2
+	}
+
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+		fmt.Fprintf(stderr, "invalid upstream URL %q\n", *upstream)
+
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           NewProxy(conf, upstreamURL),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	logrus.WithFields(logrus.Fields{"addr": *listen, "upstream": *upstream}).Info("serving")
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintln(stderr, err)
+
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // some upstreams still sign with HMAC-SHA1
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"maps"
+	"os"
+
+	"github.com/samber/lo"
+)
+
+const (
+	SignAlgorithmSHA1   = "sha1"
+	SignAlgorithmSHA256 = "sha256"
+	SignAlgorithmSHA512 = "sha512"
+)
+
+const (
+	SignEncodingHex    = "hex"
+	SignEncodingBase64 = "base64"
+)
+
+var DefaultSignHeader = "X-Signature"
+
+var ErrSignSecret = errors.New("neither secret nor secret_env is set")
+
+// SignConfig configures the signature of the requests sent to the upstream: an HMAC of the string
+// the canonical_string program builds from the request as the other programs leave it.
+type SignConfig struct {
+	CanonicalString string `json:"canonical_string"` // an optional jq query returning the string to sign, requests are only signed with one
+	Header          string `json:"header"`           // the request header set to the signature, X-Signature by default
+	Algorithm       string `json:"algorithm"`        // the HMAC hash: sha256 (default), sha1 or sha512
+	Encoding        string `json:"encoding"`         // the encoding of the signature: hex (default) or base64
+	Secret          string `json:"secret"`           // the HMAC secret
+	SecretEnv       string `json:"secret_env"`       // the environment variable holding the HMAC secret, when secret isn't set
+}
+
+func (s SignConfig) header() string {
+	return lo.Ternary(s.Header != "", s.Header, DefaultSignHeader)
+}
+
+func (s SignConfig) secret() ([]byte, error) {
+	if s.Secret != "" {
+		return []byte(s.Secret), nil
+	}
+
+	if secret := os.Getenv(s.SecretEnv); s.SecretEnv != "" && secret != "" {
+		return []byte(secret), nil
+	}
+
+	return nil, ErrSignSecret
+}
+
+// sign returns the encoded HMAC of a canonical string.
+func (s SignConfig) sign(canonicalString string) (string, error) {
+	secret, err := s.secret()
+	if err != nil {
+		return "", err
+	}
+
+	newHash := map[string]func() hash.Hash{
+		SignAlgorithmSHA1:   sha1.New,
+		SignAlgorithmSHA256: sha256.New,
+		SignAlgorithmSHA512: sha512.New,
+	}[lo.Ternary(s.Algorithm != "", s.Algorithm, SignAlgorithmSHA256)]
+	if newHash == nil {
+		return "", fmt.Errorf("unknown algorithm %q", s.Algorithm)
+	}
+
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(canonicalString))
+
+	if s.Encoding == SignEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+	}
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// signingArguments returns the context of the canonical_string program: the access phase context
+// whose request has the headers and the body sent to the upstream.
+func (conf Config) signingArguments(arguments map[string]any, headers map[string][]string, body any) map[string]any {
+	request := maps.Clone(arguments["request"].(map[string]any))
+	request["headers"] = multimapArgument(conf.normalizeHeaders(headers))
+	request["body"] = body
+
+	return lo.Assign(arguments, map[string]any{"request": request})
+}
+
+// evalSignature runs the canonical_string program against the signing context and signs its
+// result. The error is a *FieldError.
+func (conf Config) evalSignature(ctx context.Context, arguments map[string]any) (string, error) {
+	next, ok := runQuery(ctx, conf, PhaseAccess, FieldSign, conf.Sign.CanonicalString, arguments)
+	if !ok {
+		return "", &FieldError{Message: ErrorSignResult}
+	}
+
+	if err, ok := next.(error); ok {
+		return "", &FieldError{Message: ErrorSign, Err: err}
+	}
+
+	canonicalString, ok := next.(string)
+	if !ok {
+		return "", &FieldError{Message: ErrorSignResult}
+	}
+
+	signature, err := conf.Sign.sign(canonicalString)
+	if err != nil {
+		return "", &FieldError{Message: ErrorSignHMAC, Err: err}
+	}
+
+	return signature, nil
+}
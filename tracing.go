@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until initTracing installs an exporting tracer provider
+var tracer = otel.Tracer("github.com/Work4Labs/kong-jq-plugin")
+
+// initTracing exports the spans to an OTLP/HTTP endpoint, to its /v1/traces path unless it has one.
+func initTracing(ctx context.Context, endpoint string) error {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+
+	if strings.Trim(endpointURL.Path, "/") == "" {
+		endpointURL.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpointURL.String()))
+	if err != nil {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("kong-jq-plugin"),
+			semconv.ServiceVersion(Version),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("github.com/Work4Labs/kong-jq-plugin")
+
+	return nil
+}
+
+// startPhaseSpan starts the span of a plugin phase, as a child of the trace found in the
+// traceparent/tracestate request headers when there is one.
+// Kong gives us lowercased header names, which is what the map carrier expects.
+func startPhaseSpan(ctx context.Context, phase, method, path string, headers map[string][]string) (context.Context, trace.Span) {
+	carrier := propagation.MapCarrier{}
+
+	for _, k := range []string{"traceparent", "tracestate"} {
+		if values := headers[k]; len(values) > 0 {
+			carrier[k] = values[0]
+		}
+	}
+
+	ctx = propagation.TraceContext{}.Extract(ctx, carrier)
+
+	return tracer.Start(
+		ctx,
+		"kong-jq "+phase,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("kong_jq.phase", phase),
+			semconv.HTTPRequestMethodKey.String(method),
+			semconv.URLPath(path),
+		),
+	)
+}
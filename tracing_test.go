@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver stands in for an OTLP/HTTP collector, keeping the spans it receives.
+type otlpReceiver struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/v1/traces" {
+		http.NotFound(w, req)
+
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	export := &coltracepb.ExportTraceServiceRequest{}
+	if err := proto.Unmarshal(body, export); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, resourceSpans := range export.GetResourceSpans() {
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			r.spans = append(r.spans, scopeSpans.GetSpans()...)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(lo.Must(proto.Marshal(&coltracepb.ExportTraceServiceResponse{})))
+}
+
+func (r *otlpReceiver) span(name string) *tracepb.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	span, _ := lo.Find(r.spans, func(span *tracepb.Span) bool { return span.GetName() == name })
+
+	return span
+}
+
+// spanAttributes returns the string and integer attributes of a span.
+func spanAttributes(span *tracepb.Span) map[string]any {
+	attributes := map[string]any{}
+
+	for _, kv := range span.GetAttributes() {
+		if value := kv.GetValue(); value.GetStringValue() != "" {
+			attributes[kv.GetKey()] = value.GetStringValue()
+		} else {
+			attributes[kv.GetKey()] = value.GetIntValue()
+		}
+	}
+
+	return attributes
+}
+
+// TestTracing plays a request carrying a traceparent header through the plugin, exporting its
+// spans to a local OTLP receiver, and checks the phase span and the jq program spans.
+func TestTracing(t *testing.T) {
+	logrus.SetOutput(io.Discard)
+
+	receiver := &otlpReceiver{}
+
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	previousTracer, previousProvider := tracer, otel.GetTracerProvider()
+
+	if err := initTracing(context.Background(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+		tracer = previousTracer
+		otel.SetTracerProvider(previousProvider)
+	})
+
+	conf := Config{
+		Path:        `"/new" + .request.path`,
+		QueryParams: `empty`,
+	}
+
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+
+	_, _, err := conf.Play(HTTPRequest{
+		Method:  http.MethodGet,
+		Path:    "/users",
+		Headers: map[string][]string{"traceparent": {"00-" + traceID + "-" + parentID + "-01"}},
+	}, func(HTTPRequest) (HTTPResponse, error) {
+		return HTTPResponse{Status: http.StatusOK}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	phase := receiver.span("kong-jq access")
+	if phase == nil {
+		t.Fatal("missing the kong-jq access span")
+	}
+
+	if got := hex.EncodeToString(phase.GetTraceId()); got != traceID {
+		t.Errorf("expected the trace id of the traceparent header %s, got %s", traceID, got)
+	}
+
+	if got := hex.EncodeToString(phase.GetParentSpanId()); got != parentID {
+		t.Errorf("expected the parent id of the traceparent header %s, got %s", parentID, got)
+	}
+
+	path := receiver.span("jq path")
+	if path == nil {
+		t.Fatal("missing the jq path span")
+	}
+
+	if string(path.GetParentSpanId()) != string(phase.GetSpanId()) {
+		t.Error("expected the jq path span to be a child of the kong-jq access span")
+	}
+
+	attributes := spanAttributes(path)
+
+	if attributes["kong_jq.phase"] != PhaseAccess || attributes["kong_jq.field"] != FieldPath {
+		t.Errorf("unexpected phase and field attributes %v", attributes)
+	}
+
+	if attributes["kong_jq.output_type"] != "string" || attributes["kong_jq.result_size"] != int64(len("/new/users")) {
+		t.Errorf("unexpected output attributes %v", attributes)
+	}
+
+	queryParams := receiver.span("jq query_params")
+	if queryParams == nil {
+		t.Fatal("missing the jq query_params span")
+	}
+
+	if attributes := spanAttributes(queryParams); attributes["kong_jq.error_code"] != OutcomeNoResult {
+		t.Errorf("expected a %s error code, got %v", OutcomeNoResult, attributes)
+	}
+
+	if queryParams.GetStatus().GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("expected the jq query_params span to have an error status, got %v", queryParams.GetStatus())
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var skippedSharedKey = "kong_jq_skipped" // kong.ctx.shared key telling the response phase the when predicate skipped the plugin
+
+// truthy tells whether a jq value is truthy, that is neither null nor false.
+func truthy(v any) bool {
+	return v != nil && v != false
+}
+
+// evalPredicate runs a jq predicate, a predicate without any result is falsy.
+func evalPredicate(ctx context.Context, conf Config, phase, field, query string, input any) (bool, error) {
+	next, ok := runQuery(ctx, conf, phase, field, query, input)
+	if !ok {
+		return false, nil
+	}
+
+	if err, ok := next.(error); ok {
+		return false, err
+	}
+
+	return truthy(next), nil
+}
+
+// skippedFields evaluates the field predicates of a phase, returning the fields they skip.
+func (conf Config) skippedFields(ctx context.Context, phase string, arguments map[string]any) (map[string]bool, error) {
+	skipped := map[string]bool{}
+
+	for _, field := range PhaseFields[phase] {
+		predicate, ok := conf.FieldWhen[field]
+		if !ok || predicate == "" {
+			continue
+		}
+
+		run, err := evalPredicate(ctx, conf, phase, field+"."+FieldWhen, predicate, arguments)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+
+		skipped[field] = !run
+	}
+
+	return skipped, nil
+}